@@ -0,0 +1,219 @@
+package s3zip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Format is the file format of the archives.
+type Format string
+
+const (
+	// FormatZip is a zip file, whose files are compressed by the Compression policy. It is the default format.
+	FormatZip Format = "zip"
+	// FormatTar is an uncompressed tar stream.
+	FormatTar Format = "tar"
+	// FormatTarGz is a tar stream compressed by gzip.
+	FormatTarGz Format = "tar.gz"
+	// FormatTarZst is a tar stream compressed by zstd.
+	FormatTarZst Format = "tar.zst"
+)
+
+// formats lists the formats with the longest extensions first, to find the format of an S3 key.
+var formats = []Format{FormatTarZst, FormatTarGz, FormatTar, FormatZip}
+
+func (f Format) orDefault() Format {
+	if f == "" {
+		return FormatZip
+	}
+	return f
+}
+
+func (f Format) validate() error {
+	for _, v := range formats {
+		if f.orDefault() == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown format %q", f)
+}
+
+// Ext returns the file extension of the format, including the leading dot.
+func (f Format) Ext() string {
+	return "." + string(f.orDefault())
+}
+
+// ContentType returns the media type of the format.
+func (f Format) ContentType() string {
+	switch f.orDefault() {
+	case FormatTar:
+		return "application/x-tar"
+	case FormatTarGz:
+		return "application/gzip"
+	case FormatTarZst:
+		return "application/zstd"
+	default:
+		return "application/zip"
+	}
+}
+
+// formatOf returns the format of an archive by the extension of its S3 key.
+func formatOf(key string) (Format, bool) {
+	for _, f := range formats {
+		if strings.HasSuffix(key, f.Ext()) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// archiveWriter writes the files of an archive.
+type archiveWriter interface {
+	// Add writes a file named by the slash-separated name, reading its content from r.
+	Add(name string, info os.FileInfo, r io.Reader) error
+	// AddDir writes an empty directory.
+	AddDir(name string, info os.FileInfo) error
+	// AddSymlink writes a symbolic link to target.
+	AddSymlink(name string, info os.FileInfo, target string) error
+	// Close finishes the archive and returns its manifest.
+	Close() ([]*Entry, error)
+}
+
+func newArchiveWriter(w io.Writer, opts PackOptions) (archiveWriter, error) {
+	if opts.Format.orDefault() == FormatZip {
+		return newZipWriter(w, opts), nil
+	}
+	return newTarWriter(w, opts)
+}
+
+// PackOptions are the options of Pack.
+type PackOptions struct {
+	Format      Format
+	Compression Compression
+	// StripAttributes omits the modification times, permissions and ownership of the files from the archive,
+	// so that the archive only depends on the names and contents of the files.
+	StripAttributes bool
+	Symlinks        SymlinkPolicy
+	// Filter selects the archived files, its globs are matched against the paths relative to the packed directory.
+	Filter Filter
+	// Reproducible makes the archive depend only on the files and the options, so that packing the same files
+	// on any host yields the same bytes. The entries are sorted by name, the ownership of the files is omitted,
+	// the zip timestamps are written in UTC and the compressors run with fixed parameters.
+	// The modification times and permissions are kept unless they are stripped.
+	Reproducible bool
+}
+
+// ArchiveReader reads an archive created by Pack.
+type ArchiveReader struct {
+	*io.PipeReader
+	entries []*Entry
+}
+
+// Entries returns the manifest of the files in the archive.
+// It is complete only after the reader has returned io.EOF.
+func (r *ArchiveReader) Entries() []*Entry {
+	return r.entries
+}
+
+// ErrFileChanged is the error of Pack if the size or the modification time of a file changes while it is archived.
+var ErrFileChanged = errors.New("file changed while it was archived")
+
+// Pack creates an archive of the given file or directory.
+// The modification times, permissions and ownership of the files are stored unless they are stripped by the options.
+func Pack(name string, opts PackOptions) *ArchiveReader {
+	return pack(name, nil, opts)
+}
+
+// pack creates an archive of the given entries of the object at name, or of all of its entries if they are nil.
+func pack(name string, entries []walkEntry, opts PackOptions) *ArchiveReader {
+	pr, pw := io.Pipe()
+	ar := &ArchiveReader{PipeReader: pr}
+	go func() {
+		entries, err := writeArchive(pw, name, entries, opts)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		ar.entries = entries
+		pw.Close()
+	}()
+	return ar
+}
+
+// Zip creates a zip file from the given file or directory.
+func Zip(name string) *ArchiveReader {
+	return ZipCompressed(name, Compression{})
+}
+
+// ZipCompressed is Zip, which compresses the files by the compression policy.
+func ZipCompressed(name string, compression Compression) *ArchiveReader {
+	return Pack(name, PackOptions{Compression: compression})
+}
+
+func writeArchive(w io.Writer, name string, entries []walkEntry, opts PackOptions) ([]*Entry, error) {
+	aw, err := newArchiveWriter(w, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	add := func(e walkEntry) error {
+		rel := e.rel
+		if rel == "." {
+			rel = filepath.Base(name)
+		}
+
+		switch e.kind {
+		case walkDir:
+			return aw.AddDir(rel, e.info)
+		case walkSymlink:
+			return aw.AddSymlink(rel, e.info, e.target)
+		}
+
+		f, err := os.Open(e.path)
+		if err != nil {
+			return fmt.Errorf("open file: %w", err)
+		}
+		defer f.Close()
+		err = aw.Add(rel, e.info, f)
+		// A file written while it is read makes an inconsistent archive, which is detected by its size and modification time.
+		if info, serr := os.Stat(e.path); serr != nil || info.Size() != e.info.Size() || !info.ModTime().Equal(e.info.ModTime()) {
+			return fmt.Errorf("%q: %w", e.rel, ErrFileChanged)
+		}
+		return err
+	}
+
+	if entries == nil && !opts.Reproducible {
+		_, err := walkObject(name, opts.Symlinks, opts.Filter, true, func(e walkEntry) error {
+			if e.kind == walkDir && (!e.empty || e.rel == ".") {
+				return nil
+			}
+			return add(e)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("walk: %w", err)
+		}
+	} else {
+		// Reproducible archives are written after the walk, sorted by name rather than in the walk order
+		// which puts the directories after their children.
+		if entries == nil {
+			if entries, _, err = objectEntries(name, opts.Symlinks, opts.Filter); err != nil {
+				return nil, err
+			}
+		}
+		for _, e := range entries {
+			if err := add(e); err != nil {
+				return nil, fmt.Errorf("add %q: %w", e.rel, err)
+			}
+		}
+	}
+
+	manifest, err := aw.Close()
+	if err != nil {
+		return nil, fmt.Errorf("close archive: %w", err)
+	}
+	return manifest, nil
+}
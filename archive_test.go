@@ -0,0 +1,147 @@
+package s3zip
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPack(t *testing.T) {
+	dir := setupTestDir(t, "", []testFile{
+		{path: "a.txt", content: "a"},
+		{path: "foo/b.txt", content: "bb"},
+	})
+
+	for _, format := range []Format{FormatTar, FormatTarGz, FormatTarZst} {
+		t.Run(string(format), func(t *testing.T) {
+			r := Pack(dir, PackOptions{Format: format, Compression: Compression{Level: 9}})
+			defer r.Close()
+			b, err := io.ReadAll(r)
+			require.NoError(t, err)
+
+			entries := r.Entries()
+			require.Len(t, entries, 2)
+			assert.Equal(t, "a.txt", entries[0].Name)
+			assert.Equal(t, crc32.ChecksumIEEE([]byte("a")), entries[0].Crc32)
+			assert.Equal(t, "foo/b.txt", entries[1].Name)
+			assert.EqualValues(t, 2, entries[1].Size)
+
+			tr, closeTar, err := newTarReader(bytes.NewReader(b), format)
+			require.NoError(t, err)
+			defer closeTar()
+			got := make(map[string]string)
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				content, err := io.ReadAll(tr)
+				require.NoError(t, err)
+				got[h.Name] = string(content)
+			}
+			assert.Equal(t, map[string]string{"a.txt": "a", "foo/b.txt": "bb"}, got)
+		})
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	for key, want := range map[string]Format{
+		"pref/target/foo.zip":         FormatZip,
+		"pref/target/foo.tar":         FormatTar,
+		"pref/target/foo.tar.gz":      FormatTarGz,
+		"pref/target/foo.tar.zst":     FormatTarZst,
+		"pref/target/foo.tar.zip":     FormatZip,
+		"pref/target/foo.zip.tar.zst": FormatTarZst,
+	} {
+		got, ok := formatOf(key)
+		assert.True(t, ok, key)
+		assert.Equal(t, want, got, key)
+
+		object, ok := parseS3Key("/path/to/target", "pref", key)
+		assert.True(t, ok, key)
+		assert.Equal(t, key, makeS3Key("/path/to/target", "pref", object, want))
+	}
+
+	_, ok := formatOf("pref/target/foo.7z")
+	assert.False(t, ok)
+}
+
+func TestPackReproducible(t *testing.T) {
+	files := []testFile{
+		{path: "a/b.txt", content: "b"},
+		{path: "a-b.txt", content: "ab"},
+		{path: "c.txt", content: "c"},
+	}
+	// The same files created in another order and at another time.
+	dir1 := setupTestDir(t, "", files)
+	dir2 := setupTestDir(t, "", []testFile{files[2], files[1], files[0]})
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, dir := range []string{dir1, dir2} {
+		for _, f := range files {
+			require.NoError(t, os.Chtimes(filepath.Join(dir, f.path), mtime, mtime))
+		}
+	}
+
+	for _, format := range []Format{FormatZip, FormatTar, FormatTarGz, FormatTarZst} {
+		t.Run(string(format), func(t *testing.T) {
+			pack := func(dir string) ([]byte, []*Entry) {
+				r := Pack(dir, PackOptions{Format: format, Reproducible: true})
+				defer r.Close()
+				b, err := io.ReadAll(r)
+				require.NoError(t, err)
+				return b, r.Entries()
+			}
+
+			b1, entries := pack(dir1)
+			b2, _ := pack(dir2)
+			assert.Equal(t, b1, b2)
+
+			names := make([]string, len(entries))
+			for i, e := range entries {
+				names[i] = e.Name
+			}
+			assert.Equal(t, []string{"a-b.txt", "a/b.txt", "c.txt"}, names, "entries should be sorted by name")
+		})
+	}
+}
+
+func TestParseArchiveKey(t *testing.T) {
+	for key, want := range map[string]archiveKey{
+		"pref/target/foo.zip":                      {object: "foo"},
+		"pref/target/foo.part-0002.tar.zst":        {object: "foo", part: 2},
+		"pref/target/.s3zip-pack-0003.zip":         {object: ".", pack: 3},
+		"pref/target/foo/bar/.s3zip-pack-0001.tar": {object: "foo/bar", pack: 1},
+		"pref/target/foo.part-x.zip":               {object: "foo.part-x"},
+	} {
+		got, ok := parseArchiveKey("/path/to/target", "pref", key)
+		assert.True(t, ok, key)
+		assert.Equal(t, want, got, key)
+	}
+
+	assert.Equal(t, "pref/target/foo/bar/.s3zip-pack-0001.tar", makeS3PackKey("/path/to/target", "pref", "foo/bar", 1, FormatTar))
+	assert.Equal(t, "pref/target/foo.part-0002.tar.zst", makeS3PartKey("/path/to/target", "pref", "foo", 2, FormatTarZst))
+}
+
+func TestPackFileChanged(t *testing.T) {
+	dir := setupTestDir(t, "", []testFile{
+		{path: "a.txt", content: "a"},
+		{path: "b.txt", content: "b"},
+	})
+	entries, _, err := objectEntries(dir, SymlinksSkip, Filter{})
+	require.NoError(t, err)
+	// The file is written after it has been listed, as if it were written while it is archived.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.txt"), []byte("bb"), 0o644))
+
+	r := pack(dir, entries, PackOptions{Format: FormatTar})
+	defer r.Close()
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, ErrFileChanged)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hareku/s3zip"
+)
+
+// get handles "s3zip cat <target> <path>" and "s3zip get <target> <path> [<dest>]".
+// cat writes the file to stdout, and get writes it to dest which defaults to the base name of path.
+// get writes a temporary file beside dest and renames it when it is complete, with the attributes stored in the archive
+// unless they are stripped, so that a failed download leaves no partial file.
+func get(ctx context.Context, conf *s3zip.Config, s3svc *s3.S3, cmd string, args []string) error {
+	if (cmd == "cat" && len(args) != 2) || (cmd == "get" && len(args) != 2 && len(args) != 3) {
+		return fmt.Errorf("usage: s3zip cat <target> <path> | s3zip get <target> <path> [<dest>]")
+	}
+
+	t, err := conf.Target(args[0])
+	if err != nil {
+		return err
+	}
+
+	var (
+		w    io.Writer = os.Stdout
+		f    *os.File
+		dest string
+	)
+	if cmd == "get" {
+		dest = path.Base(args[1])
+		if len(args) == 3 {
+			dest = args[2]
+		}
+
+		// The file is created with the permissions of os.Create, which are replaced by the stored ones if any.
+		tmp := filepath.Join(filepath.Dir(dest), fmt.Sprintf(".%s.s3zip-%d.tmp", filepath.Base(dest), os.Getpid()))
+		f, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
+		if err != nil {
+			return fmt.Errorf("create file: %w", err)
+		}
+		defer os.Remove(tmp) // fails once renamed
+		defer f.Close()
+		w = f
+	}
+
+	result, err := s3zip.Get(ctx, &s3zip.GetInput{
+		S3Bucket:  conf.S3.Bucket,
+		S3Service: s3svc,
+		Path:      t.Path,
+		OutPrefix: t.OutPrefix,
+		Format:    t.Format,
+		Name:      args[1],
+		Writer:    w,
+	})
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+
+	if f != nil {
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("close file: %w", err)
+		}
+		if !t.StripAttributes {
+			if err := result.ApplyAttributes(f.Name()); err != nil {
+				return fmt.Errorf("set attributes: %w", err)
+			}
+		}
+		if err := os.Rename(f.Name(), dest); err != nil {
+			return fmt.Errorf("rename file: %w", err)
+		}
+	}
+	slog.InfoContext(ctx, "Done", "result", result)
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/dustin/go-humanize"
+	"github.com/hareku/s3zip"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// list handles "s3zip ls <target> [<archive>]".
+// It prints the archives of the target, or the files of an archive given by its object name or S3 key.
+func list(ctx context.Context, conf *s3zip.Config, s3svc *s3.S3, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("usage: s3zip ls <target> [<archive>]")
+	}
+
+	t, err := conf.Target(args[0])
+	if err != nil {
+		return err
+	}
+
+	store, err := s3zip.LoadMetadataStore(ctx, s3svc, conf.S3.Bucket, conf.Metadata)
+	if err != nil {
+		return fmt.Errorf("load metadata store: %w", err)
+	}
+	archives := s3zip.ListArchives(store, t.Path, t.OutPrefix)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if len(args) == 1 {
+		fmt.Fprintln(w, "KEY\tSIZE\tSOURCE SIZE\tFILES\tUPLOADED\tSTORAGE CLASS\tSHA-256")
+		for _, a := range archives {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", a.Key, humanize.Bytes(uint64(a.Size)), humanize.Bytes(uint64(a.SourceSize)),
+				len(a.Entries), formatTime(a.UploadedAt), a.StorageClass, formatSHA256(a.Sha256))
+		}
+		return w.Flush()
+	}
+
+	// The parts of a split object are listed together by the object name.
+	found := false
+	for _, a := range archives {
+		if a.Object != args[1] && a.Key != args[1] {
+			continue
+		}
+
+		if !found {
+			fmt.Fprintln(w, "PATH\tSIZE\tMODIFIED")
+			found = true
+		}
+		for _, f := range a.Files() {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", f.Path, humanize.Bytes(uint64(f.Entry.Size)), formatTime(f.Entry.Modified))
+		}
+	}
+	if !found {
+		return fmt.Errorf("archive %q not found", args[1])
+	}
+	return w.Flush()
+}
+
+// find handles "s3zip find <glob>".
+// It prints the files matching the glob in the archives of all targets.
+func find(ctx context.Context, conf *s3zip.Config, s3svc *s3.S3, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: s3zip find <glob>")
+	}
+
+	store, err := s3zip.LoadMetadataStore(ctx, s3svc, conf.S3.Bucket, conf.Metadata)
+	if err != nil {
+		return fmt.Errorf("load metadata store: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tPATH\tSIZE\tKEY")
+	for _, t := range conf.Targets {
+		files, err := s3zip.FindFiles(store, t.Path, t.OutPrefix, args[0])
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", filepath.Base(t.Path), f.Path, humanize.Bytes(uint64(f.Entry.Size)), f.Key)
+		}
+	}
+	return w.Flush()
+}
+
+func formatSHA256(sum []byte) string {
+	if len(sum) == 0 {
+		return "-"
+	}
+	return hex.EncodeToString(sum)
+}
+
+func formatTime(t *timestamppb.Timestamp) string {
+	if t == nil {
+		return "-"
+	}
+	return t.AsTime().Local().Format(time.DateTime)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 
 	"log/slog"
 
@@ -20,6 +21,7 @@ var (
 	dryFlag         = flag.Bool("dry", false, "dry run")
 	debugFlag       = flag.Bool("debug", false, "debug mode")
 	concurrencyFlag = flag.Int("concurrency", s3zip.DefaultConcurrency, "concurrency")
+	rehashFlag      = flag.Bool("rehash", false, "hash all objects again instead of using the hash cache")
 )
 
 var (
@@ -73,8 +75,43 @@ func run() error {
 		Region: aws.String(conf.S3.Region),
 	})
 
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+		return upload(ctx, conf, s3svc)
+	case "restore":
+		return restore(ctx, conf, s3svc, flag.Args()[1:])
+	case "cat", "get":
+		return get(ctx, conf, s3svc, cmd, flag.Args()[1:])
+	case "ls":
+		return list(ctx, conf, s3svc, flag.Args()[1:])
+	case "find":
+		return find(ctx, conf, s3svc, flag.Args()[1:])
+	case "reindex":
+		return reindex(ctx, conf, s3svc, flag.Args()[1:])
+	case "thaw":
+		return thaw(ctx, conf, s3svc, flag.Args()[1:])
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+func upload(ctx context.Context, conf *s3zip.Config, s3svc *s3.S3) error {
+	cachePath := conf.Cache
+	if cachePath == "" {
+		cachePath = filepath.Join(filepath.Dir(*configFlag), s3zip.DefaultHashCacheName)
+	}
+	cache, err := s3zip.OpenHashCache(cachePath)
+	if err != nil {
+		return fmt.Errorf("open hash cache: %w", err)
+	}
+	defer cache.Close()
+
 	for i, t := range conf.Targets {
 		slog.InfoContext(ctx, "Start", "i", i, "target", t)
+		var autoDepth *s3zip.AutoDepth
+		if t.AutoDepth != nil {
+			autoDepth = &s3zip.AutoDepth{MinSize: int64(t.AutoDepth.MinSize), MaxSize: int64(t.AutoDepth.MaxSize)}
+		}
 		result, err := s3zip.Run(ctx, &s3zip.RunInput{
 			DryRun:           *dryFlag,
 			S3Bucket:         conf.S3.Bucket,
@@ -83,8 +120,26 @@ func run() error {
 			MetadataStoreKey: conf.Metadata,
 			Path:             t.Path,
 			MaxZipDepth:      t.MaxZipDepth,
+			DepthRules:       t.DepthRules,
 			OutPrefix:        t.OutPrefix,
 			Concurrency:      *concurrencyFlag,
+			Version:          version,
+			HashMode:         t.HashMode,
+			Format:           t.Format,
+			Compression:      t.Compression,
+			StripAttributes:  t.StripAttributes,
+			Symlinks:         t.Symlinks,
+			Reproducible:     t.Reproducible,
+			MaxArchiveSize:   int64(t.MaxArchiveSize),
+			MinArchiveSize:   int64(t.MinArchiveSize),
+			AutoDepth:        autoDepth,
+			Filter:           s3zip.Filter{Include: t.Include, Exclude: t.Exclude},
+			MinAge:           t.MinAge,
+			HashCache:        cache,
+			Rehash:           *rehashFlag,
+
+			CheckpointUploads:  conf.Checkpoint.Uploads,
+			CheckpointInterval: conf.Checkpoint.Interval,
 		})
 		if err != nil {
 			return fmt.Errorf("run: %w", err)
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hareku/s3zip"
+)
+
+// reindex handles "s3zip reindex [<target>...]".
+// It rebuilds the metadata store from the archives of the given targets, or of all targets.
+func reindex(ctx context.Context, conf *s3zip.Config, s3svc *s3.S3, args []string) error {
+	targets := conf.Targets
+	if len(args) > 0 {
+		targets = make([]s3zip.ConfigTarget, 0, len(args))
+		for _, arg := range args {
+			t, err := conf.Target(arg)
+			if err != nil {
+				return err
+			}
+			targets = append(targets, *t)
+		}
+	}
+
+	for i, t := range targets {
+		slog.InfoContext(ctx, "Start reindex", "i", i, "target", t)
+		result, err := s3zip.Reindex(ctx, &s3zip.ReindexInput{
+			DryRun:           *dryFlag,
+			S3Bucket:         conf.S3.Bucket,
+			S3Service:        s3svc,
+			MetadataStoreKey: conf.Metadata,
+			Path:             t.Path,
+			OutPrefix:        t.OutPrefix,
+			Concurrency:      *concurrencyFlag,
+		})
+		if err != nil {
+			return fmt.Errorf("reindex: %w", err)
+		}
+		slog.InfoContext(ctx, "Done", "result", result)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hareku/s3zip"
+)
+
+// restore handles "s3zip restore <target> <dest>".
+func restore(ctx context.Context, conf *s3zip.Config, s3svc *s3.S3, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: s3zip restore <target> <dest>")
+	}
+
+	t, err := conf.Target(args[0])
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Start restore", "target", t, "dest", args[1])
+	result, err := s3zip.Restore(ctx, &s3zip.RestoreInput{
+		DryRun:      *dryFlag,
+		S3Bucket:    conf.S3.Bucket,
+		S3Service:   s3svc,
+		Path:        t.Path,
+		OutPrefix:   t.OutPrefix,
+		Dest:        args[1],
+		Concurrency: *concurrencyFlag,
+	})
+	if err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	slog.InfoContext(ctx, "Done", "result", result)
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hareku/s3zip"
+)
+
+// thaw handles "s3zip thaw [-tier <tier>] [-days <days>] [-status] <target>".
+func thaw(ctx context.Context, conf *s3zip.Config, s3svc *s3.S3, args []string) error {
+	fs := flag.NewFlagSet("thaw", flag.ContinueOnError)
+	tier := fs.String("tier", s3zip.DefaultThawTier, "restore tier (Bulk | Standard | Expedited)")
+	days := fs.Int("days", s3zip.DefaultThawDays, "days to keep the restored copies")
+	status := fs.Bool("status", false, "report the state of the restore requests")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: s3zip thaw [-tier <tier>] [-days <days>] [-status] <target>")
+	}
+
+	t, err := conf.Target(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	in := &s3zip.ThawInput{
+		DryRun:           *dryFlag,
+		S3Bucket:         conf.S3.Bucket,
+		S3Service:        s3svc,
+		MetadataStoreKey: conf.Metadata,
+		Path:             t.Path,
+		OutPrefix:        t.OutPrefix,
+		Tier:             *tier,
+		Days:             *days,
+		Concurrency:      *concurrencyFlag,
+	}
+
+	if *status {
+		result, err := s3zip.ThawStatus(ctx, in)
+		if err != nil {
+			return fmt.Errorf("thaw status: %w", err)
+		}
+
+		counts := make(map[s3zip.ThawState]int)
+		for _, a := range result.Archives {
+			counts[a.State]++
+			fmt.Printf("%s\t%s\n", a.State, a.Key)
+		}
+		slog.InfoContext(ctx, "Done", "archives", len(result.Archives),
+			"ready", counts[s3zip.ThawStateReady], "pending", counts[s3zip.ThawStatePending],
+			"expired", counts[s3zip.ThawStateExpired], "not-requested", counts[s3zip.ThawStateNotRequested])
+		return nil
+	}
+
+	slog.InfoContext(ctx, "Start thaw", "target", t, "tier", *tier, "days", *days)
+	result, err := s3zip.Thaw(ctx, in)
+	if err != nil {
+		return fmt.Errorf("thaw: %w", err)
+	}
+	counts := make(map[s3zip.ThawState]int)
+	for _, a := range result.Archives {
+		counts[a.State]++
+	}
+	slog.InfoContext(ctx, "Done", "archives", len(result.Archives),
+		"pending", counts[s3zip.ThawStatePending], "ready", counts[s3zip.ThawStateReady])
+	return nil
+}
@@ -0,0 +1,84 @@
+package s3zip
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// autoCompressionSampleSize is the size of the first chunk of a file which is compressed to decide its method in auto mode.
+	autoCompressionSampleSize = 64 * 1024
+	// autoCompressionMaxRatio is the compressed to original size ratio of the sample above which a file is stored.
+	autoCompressionMaxRatio = 0.9
+)
+
+// Compression is the compression policy of the files in the archives.
+// The zero value deflates all files with the default level.
+// Store and Auto apply to zip archives only, tar archives are compressed as a whole with Level.
+type Compression struct {
+	// Store lists the extensions (e.g. ".jpg") or globs of base names (e.g. "*.mp?") of the files which are stored uncompressed.
+	// They are matched case-insensitively.
+	Store []string `yaml:"store"`
+	// Level is the deflate level from 1 (best speed) to 9 (best compression), 0 means the default level.
+	// It is also the gzip level of FormatTarGz, and is mapped to the nearest zstd level for FormatTarZst.
+	Level int `yaml:"level"`
+	// Auto stores the files whose first chunk does not shrink well by deflate.
+	Auto bool `yaml:"auto"`
+}
+
+func (c Compression) validate() error {
+	if c.Level < 0 || c.Level > flate.BestCompression {
+		return fmt.Errorf("level %d is out of range 0 to %d", c.Level, flate.BestCompression)
+	}
+	for _, p := range c.Store {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("store %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// level returns the flate level of Level.
+func (c Compression) level() int {
+	if c.Level == 0 {
+		return flate.DefaultCompression
+	}
+	return c.Level
+}
+
+// method returns the zip method of the file, whose first chunk is sample in auto mode.
+func (c Compression) method(name string, sample []byte) uint16 {
+	base := strings.ToLower(filepath.Base(name))
+	for _, p := range c.Store {
+		p = strings.ToLower(p)
+		if strings.HasPrefix(p, ".") && strings.HasSuffix(base, p) {
+			return zip.Store
+		}
+		if ok, _ := path.Match(p, base); ok {
+			return zip.Store
+		}
+	}
+	if c.Auto && !compressible(sample) {
+		return zip.Store
+	}
+	return zip.Deflate
+}
+
+// compressible reports whether the sample shrinks well by deflate.
+func compressible(sample []byte) bool {
+	if len(sample) == 0 {
+		return true
+	}
+
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	// Writing to a bytes.Buffer does not fail.
+	w.Write(sample)
+	w.Close()
+	return float64(buf.Len())/float64(len(sample)) <= autoCompressionMaxRatio
+}
@@ -0,0 +1,46 @@
+package s3zip
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	t.Run("method", func(t *testing.T) {
+		c := Compression{Store: []string{".jpg", ".tar.gz", "*.mp?"}}
+		for name, want := range map[string]uint16{
+			"a.jpg":        zip.Store,
+			"foo/IMG.JPG":  zip.Store,
+			"a.tar.gz":     zip.Store,
+			"a.mp4":        zip.Store,
+			"a.txt":        zip.Deflate,
+			"jpg":          zip.Deflate,
+			"foo.jpg/a.gz": zip.Deflate,
+		} {
+			assert.Equal(t, want, c.method(name, nil), name)
+		}
+	})
+
+	t.Run("auto", func(t *testing.T) {
+		random := make([]byte, 4096)
+		rand.Read(random)
+		text := bytes.Repeat([]byte("s3zip "), 1000)
+
+		c := Compression{Auto: true}
+		assert.Equal(t, uint16(zip.Store), c.method("a.bin", random))
+		assert.Equal(t, uint16(zip.Deflate), c.method("a.txt", text))
+		assert.Equal(t, uint16(zip.Deflate), c.method("empty", nil))
+		assert.Equal(t, uint16(zip.Deflate), Compression{}.method("a.bin", random), "random data should be deflated without auto")
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		assert.NoError(t, Compression{Store: []string{".jpg", "*.mp?"}, Level: 9}.validate())
+		assert.Error(t, Compression{Level: 10}.validate())
+		assert.Error(t, Compression{Level: -1}.validate())
+		assert.Error(t, Compression{Store: []string{"[a"}}.validate())
+	})
+}
@@ -3,14 +3,20 @@ package s3zip
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	S3       ConfigS3       `yaml:"s3"`
-	Metadata string         `yaml:"metadata"`
-	Targets  []ConfigTarget `yaml:"targets"`
+	S3       ConfigS3 `yaml:"s3"`
+	Metadata string   `yaml:"metadata"`
+	// Cache is the path of the hash cache file, DefaultHashCacheName beside the config file if empty.
+	Cache      string           `yaml:"cache"`
+	Checkpoint ConfigCheckpoint `yaml:"checkpoint"`
+	Targets    []ConfigTarget   `yaml:"targets"`
 }
 
 type ConfigS3 struct {
@@ -19,10 +25,55 @@ type ConfigS3 struct {
 	StorageClass string `yaml:"storage_class"`
 }
 
+// ConfigCheckpoint configures how often the metadata store is saved during uploads.
+type ConfigCheckpoint struct {
+	Uploads  int           `yaml:"uploads"`
+	Interval time.Duration `yaml:"interval"`
+}
+
 type ConfigTarget struct {
-	Path        string `yaml:"path"`
-	MaxZipDepth int    `yaml:"max_zip_depth"`
-	OutPrefix   string `yaml:"out_prefix"`
+	Path        string      `yaml:"path"`
+	MaxZipDepth int         `yaml:"max_zip_depth"`
+	OutPrefix   string      `yaml:"out_prefix"`
+	HashMode    HashMode    `yaml:"hash_mode"`
+	Format      Format      `yaml:"format"`
+	Compression Compression `yaml:"compression"`
+	// StripAttributes omits the modification times, permissions and ownership of the files from the archives.
+	StripAttributes bool          `yaml:"strip_attributes"`
+	Symlinks        SymlinkPolicy `yaml:"symlinks"`
+	// Reproducible makes the archives byte-reproducible, see PackOptions.
+	Reproducible bool `yaml:"reproducible"`
+	// MaxArchiveSize splits the objects larger than it into parts, 0 disables it.
+	MaxArchiveSize ByteSize `yaml:"max_archive_size"`
+	// MinArchiveSize packs the sibling objects smaller than it together, 0 disables it.
+	MinArchiveSize ByteSize `yaml:"min_archive_size"`
+	// DepthRules override MaxZipDepth in the subtrees of the target.
+	DepthRules []DepthRule `yaml:"depth_rules"`
+	// AutoDepth selects the objects by their sizes instead of MaxZipDepth if it is set.
+	AutoDepth *ConfigAutoDepth `yaml:"auto_depth"`
+	// Include and Exclude are the globs of the files to archive, see Filter.
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+	// MinAge skips the objects modified within it, 0 disables it.
+	MinAge time.Duration `yaml:"min_age"`
+}
+
+// ConfigAutoDepth configures the auto depth mode, see AutoDepth.
+type ConfigAutoDepth struct {
+	MinSize ByteSize `yaml:"min_size"`
+	MaxSize ByteSize `yaml:"max_size"`
+}
+
+// ByteSize is a number of bytes, written in the config file as a number or a string such as "10GB" or "512MiB".
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	n, err := humanize.ParseBytes(value.Value)
+	if err != nil {
+		return fmt.Errorf("parse size %q: %w", value.Value, err)
+	}
+	*b = ByteSize(n)
+	return nil
 }
 
 func ReadConfig(name string) (*Config, error) {
@@ -38,3 +89,13 @@ func ReadConfig(name string) (*Config, error) {
 	}
 	return &c, nil
 }
+
+// Target returns the target whose path or base name equals name.
+func (c *Config) Target(name string) (*ConfigTarget, error) {
+	for i, t := range c.Targets {
+		if t.Path == name || filepath.Base(t.Path) == name {
+			return &c.Targets[i], nil
+		}
+	}
+	return nil, fmt.Errorf("target %q not found", name)
+}
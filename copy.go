@@ -0,0 +1,156 @@
+package s3zip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Limits of server-side copies, variables for tests.
+var (
+	// maxCopyObjectSize is the largest object which can be copied by a single CopyObject request.
+	maxCopyObjectSize int64 = 5 * 1024 * 1024 * 1024
+	// copyPartSize is the minimum part size of multipart copies, which have at most 10,000 parts.
+	copyPartSize int64 = 512 * 1024 * 1024
+)
+
+// copyArchive copies the archive at the key src, whose metadata is m, to the object v without downloading it.
+// It returns the metadata of the copy.
+func (c *runClient) copyArchive(ctx context.Context, v ObjectToUpload, src string, m *Metadata) (*Metadata, error) {
+	dst := v.Key
+	slog.InfoContext(ctx, "Copying renamed archive", "name", v.Name, "from", src)
+
+	m = proto.Clone(m).(*Metadata)
+	m.Thaw = nil
+	m.StorageClass = c.s3StorageClass
+	if c.dryRun {
+		return m, nil
+	}
+	if m.Size == 0 {
+		// The metadata of older versions has no size of the archive.
+		head, err := c.s3Service.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: &c.s3Bucket,
+			Key:    aws.String(src),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("head %q: %w", src, err)
+		}
+		m.Size = aws.Int64Value(head.ContentLength)
+	}
+
+	var etag, versionID *string
+	if m.Size > maxCopyObjectSize {
+		out, err := c.copyMultipart(ctx, src, dst, m)
+		if err != nil {
+			return nil, err
+		}
+		etag, versionID = out.ETag, out.VersionId
+	} else {
+		out, err := c.s3Service.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:       &c.s3Bucket,
+			Key:          aws.String(dst),
+			CopySource:   aws.String(copySource(c.s3Bucket, src)),
+			StorageClass: &c.s3StorageClass,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("copy object: %w", err)
+		}
+		if out.CopyObjectResult != nil {
+			etag = out.CopyObjectResult.ETag
+		}
+		versionID = out.VersionId
+	}
+
+	m.UploadedAt = timestamppb.Now()
+	m.Etag = aws.StringValue(etag)
+	m.VersionId = aws.StringValue(versionID)
+	return m, nil
+}
+
+// copyMultipart copies src to dst with a multipart upload, for objects larger than a single CopyObject supports.
+func (c *runClient) copyMultipart(ctx context.Context, src, dst string, m *Metadata) (*s3.CompleteMultipartUploadOutput, error) {
+	upload, err := c.s3Service.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:       &c.s3Bucket,
+		Key:          aws.String(dst),
+		ContentType:  aws.String(c.format.ContentType()),
+		StorageClass: &c.s3StorageClass,
+		Metadata:     archiveUserMetadata(m),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create multipart upload: %w", err)
+	}
+
+	out, err := c.copyParts(ctx, src, dst, upload.UploadId, m.Size)
+	if err != nil {
+		_, aerr := c.s3Service.AbortMultipartUploadWithContext(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   &c.s3Bucket,
+			Key:      aws.String(dst),
+			UploadId: upload.UploadId,
+		})
+		if aerr != nil {
+			slog.WarnContext(ctx, "Failed to abort multipart upload", "s3-key", dst, "error", aerr)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *runClient) copyParts(ctx context.Context, src, dst string, uploadID *string, size int64) (*s3.CompleteMultipartUploadOutput, error) {
+	partSize := max(copyPartSize, (size+9999)/10000)
+
+	var parts []*s3.CompletedPart
+	for start := int64(0); start < size; start += partSize {
+		n := int64(len(parts) + 1)
+		out, err := c.s3Service.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          &c.s3Bucket,
+			Key:             aws.String(dst),
+			UploadId:        uploadID,
+			PartNumber:      aws.Int64(n),
+			CopySource:      aws.String(copySource(c.s3Bucket, src)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, min(start+partSize, size)-1)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("copy part %d: %w", n, err)
+		}
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       out.CopyPartResult.ETag,
+			PartNumber: aws.Int64(n),
+		})
+	}
+
+	out, err := c.s3Service.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &c.s3Bucket,
+		Key:             aws.String(dst),
+		UploadId:        uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("complete multipart upload: %w", err)
+	}
+	return out, nil
+}
+
+// isInvalidObjectState reports whether a request failed because the object is archived and not restored.
+func isInvalidObjectState(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeInvalidObjectState
+}
+
+// copySource returns the URL-encoded source of a copy request.
+func copySource(bucket, key string) string {
+	segments := strings.Split(bucket+"/"+key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
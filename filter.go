@@ -0,0 +1,98 @@
+package s3zip
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// Filter selects the files of the objects by globs in the doublestar syntax, e.g. "**/*.tmp" or "photos/**".
+// The globs are matched against the slash-separated paths relative to the walked file or directory,
+// or to the target in a run. A glob without a slash, e.g. "node_modules" or "*.tmp", matches the base names at any depth.
+// The zero value selects all files.
+type Filter struct {
+	// Include selects only the files which match one of the globs, or are in a directory which does, if it is not empty.
+	Include []string
+	// Exclude skips the files and directories which match one of the globs, with all of their entries.
+	Exclude []string
+
+	// prefix is the path of the walked object under which the paths are matched, "" for the walked directory itself.
+	prefix string
+}
+
+func (f Filter) validate() error {
+	for _, p := range f.Include {
+		if !doublestar.ValidatePattern(p) {
+			return fmt.Errorf("include %q: %w", p, doublestar.ErrBadPattern)
+		}
+	}
+	for _, p := range f.Exclude {
+		if !doublestar.ValidatePattern(p) {
+			return fmt.Errorf("exclude %q: %w", p, doublestar.ErrBadPattern)
+		}
+	}
+	return nil
+}
+
+// selectsAll reports whether the filter has no globs.
+func (f Filter) selectsAll() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0
+}
+
+// under returns the filter of the object at the slash-separated path relative to the filtered directory.
+func (f Filter) under(object string) Filter {
+	f.prefix = path.Join(f.prefix, object)
+	return f
+}
+
+// path returns the matched path of the entry at rel in the walked object, "" if it is the filtered directory itself.
+func (f Filter) path(rel string) string {
+	p := path.Join(f.prefix, rel)
+	if p == "." {
+		return ""
+	}
+	return p
+}
+
+// excluded reports whether the entry at rel in the walked object is skipped.
+func (f Filter) excluded(rel string) bool {
+	p := f.path(rel)
+	return p != "" && matchAny(f.Exclude, p)
+}
+
+// included reports whether the entry at rel in the walked object is selected by Include.
+func (f Filter) included(rel string) bool {
+	p := f.path(rel)
+	if len(f.Include) == 0 || p == "" {
+		return true
+	}
+	for ; ; p = path.Dir(p) {
+		if matchAny(f.Include, p) {
+			return true
+		}
+		if !strings.Contains(p, "/") {
+			break
+		}
+	}
+	return false
+}
+
+// String returns a description of the filter which changes with its globs, for keys of the hash cache.
+func (f Filter) String() string {
+	return fmt.Sprintf("include=%q exclude=%q", f.Include, f.Exclude)
+}
+
+func matchAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		name := p
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(p)
+		}
+		if ok, _ := doublestar.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
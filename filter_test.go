@@ -0,0 +1,87 @@
+package s3zip
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	dir := setupTestDir(t, "", []testFile{
+		{path: "a.txt", content: "a"},
+		{path: "a.tmp", content: "a"},
+		{path: "foo/.DS_Store", content: "x"},
+		{path: "foo/b.jpg", content: "b"},
+		{path: "foo/node_modules/c.js", content: "c"},
+		{path: "photos/d.jpg", content: "d"},
+		{path: "photos/e.txt", content: "e"},
+	})
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{
+			name: "all",
+			want: []string{"a.tmp", "a.txt", "foo/.DS_Store", "foo/b.jpg", "foo/node_modules/c.js", "photos/d.jpg", "photos/e.txt"},
+		},
+		{
+			name:   "exclude base names",
+			filter: Filter{Exclude: []string{"*.tmp", ".DS_Store", "node_modules"}},
+			want:   []string{"a.txt", "foo/b.jpg", "photos/d.jpg", "photos/e.txt"},
+		},
+		{
+			name:   "exclude paths",
+			filter: Filter{Exclude: []string{"foo/**/*.js", "photos/*.txt"}},
+			want:   []string{"a.tmp", "a.txt", "foo/.DS_Store", "foo/b.jpg", "photos/d.jpg"},
+		},
+		{
+			name:   "include",
+			filter: Filter{Include: []string{"*.jpg"}},
+			want:   []string{"foo/b.jpg", "photos/d.jpg"},
+		},
+		{
+			name:   "include directory",
+			filter: Filter{Include: []string{"photos"}, Exclude: []string{"*.txt"}},
+			want:   []string{"photos/d.jpg"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, _, err := objectEntries(dir, SymlinksFollow, tt.filter)
+			require.NoError(t, err)
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.rel)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("objects", func(t *testing.T) {
+		filter := Filter{Include: []string{"*.jpg"}}
+		got, err := LocalObjects(dir, 1, nil, SymlinksFollow, filter)
+		require.NoError(t, err)
+		sort.Strings(got)
+		assert.Equal(t, []string{"foo", "photos"}, got, "the objects without included files should be skipped")
+
+		got, err = LocalObjects(dir, 2, nil, SymlinksFollow, Filter{Exclude: []string{"foo"}})
+		require.NoError(t, err)
+		sort.Strings(got)
+		assert.Equal(t, []string{"a.tmp", "a.txt", "photos/d.jpg", "photos/e.txt"}, got)
+
+		h1, err := Hash(dir+"/foo", HashModeSize, SymlinksFollow, filter.under("foo"))
+		require.NoError(t, err)
+		h2, err := Hash(dir+"/foo", HashModeSize, SymlinksFollow, Filter{Include: []string{"foo/b.jpg"}}.under("foo"))
+		require.NoError(t, err)
+		assert.Equal(t, h1, h2, "the globs should be matched against the paths relative to the target")
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		assert.NoError(t, Filter{Include: []string{"**/*.jpg"}, Exclude: []string{"{a,b}/*"}}.validate())
+		assert.Error(t, Filter{Exclude: []string{"[a"}}.validate())
+	})
+}
@@ -0,0 +1,304 @@
+package s3zip
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// s3ReadAtBlockSize is the minimum number of bytes fetched by a ranged GET.
+// zip.Reader reads the central directory and the entries in small chunks, so each request reads ahead.
+const s3ReadAtBlockSize = 1024 * 1024
+
+var ErrFileNotFound = errors.New("file not found")
+
+type (
+	GetInput struct {
+		S3Bucket  string
+		S3Service s3iface.S3API
+		Path      string
+		OutPrefix string
+		Format    Format
+
+		// Name is the slash-separated path of the file relative to the target.
+		Name string
+		// Writer receives the content of the file.
+		Writer io.Writer
+	}
+
+	GetOutput struct {
+		Key   string
+		Entry string
+		Size  int64
+
+		attributes fileAttributes
+	}
+)
+
+// Get extracts a single file out of the remote archives of a target.
+// For zip archives, only the central directory of the archive and the entry of the file are downloaded using ranged GETs.
+// Tar archives have no index, so they are read from the beginning up to the file.
+func Get(ctx context.Context, in *GetInput) (*GetOutput, error) {
+	name := path.Clean(in.Name)
+	if name == "." || !filepath.IsLocal(filepath.FromSlash(name)) {
+		return nil, fmt.Errorf("invalid name: %q", in.Name)
+	}
+
+	// The file is in the archive of one of its ancestors, or of itself if it was zipped alone.
+	object, entry := name, path.Base(name)
+	for {
+		key := makeS3Key(in.Path, in.OutPrefix, object, in.Format)
+		head, err := headArchive(ctx, in.S3Service, in.S3Bucket, key)
+		if err != nil {
+			return nil, fmt.Errorf("head %q: %w", key, err)
+		}
+		if head != nil {
+			if object == name && metadataFromHead(head).ObjectKind == objectKindDir {
+				// The name is a directory, even if it holds a file of the same name.
+				return nil, fmt.Errorf("%w: %q", ErrFileNotFound, in.Name)
+			}
+			slog.DebugContext(ctx, "Found archive", "s3-key", key, "entry", entry)
+			return getEntry(ctx, in, key, aws.Int64Value(head.ContentLength), entry)
+		}
+
+		// A split object is in its parts, and a small object may be in a pack of the directory.
+		partial, err := listPartialArchives(ctx, in, object)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range partial {
+			slog.DebugContext(ctx, "Found partial archive", "s3-key", a.key, "entry", entry)
+			out, err := getEntry(ctx, in, a.key, a.size, entry)
+			if !errors.Is(err, ErrFileNotFound) {
+				return out, err
+			}
+		}
+		if len(partial) > 0 {
+			return nil, fmt.Errorf("%w: %q", ErrFileNotFound, in.Name)
+		}
+
+		if object == "." {
+			return nil, fmt.Errorf("%w: %q", ErrFileNotFound, in.Name)
+		}
+		object = path.Dir(object)
+		if object == "." {
+			entry = name
+		} else {
+			entry = name[len(object)+1:]
+		}
+	}
+}
+
+func getEntry(ctx context.Context, in *GetInput, key string, size int64, entry string) (*GetOutput, error) {
+	if in.Format.orDefault() != FormatZip {
+		return getTarEntry(ctx, in, key, entry)
+	}
+
+	ra := &s3ReaderAt{
+		ctx:       ctx,
+		s3Service: in.S3Service,
+		s3Bucket:  in.S3Bucket,
+		key:       key,
+		size:      size,
+	}
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return nil, fmt.Errorf("open zip %q: %w", key, err)
+	}
+
+	for _, zf := range zr.File {
+		if zf.Name != entry {
+			continue
+		}
+
+		r, err := zf.Open()
+		if err != nil {
+			return nil, fmt.Errorf("open %q in %q: %w", entry, key, err)
+		}
+		defer r.Close()
+
+		n, err := io.Copy(in.Writer, r)
+		if err != nil {
+			return nil, fmt.Errorf("copy %q in %q: %w", entry, key, err)
+		}
+		return &GetOutput{
+			Key:        key,
+			Entry:      entry,
+			Size:       n,
+			attributes: zipAttributes(zf),
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: %q in %q", ErrFileNotFound, entry, key)
+}
+
+func getTarEntry(ctx context.Context, in *GetInput, key string, entry string) (*GetOutput, error) {
+	out, err := in.S3Service.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: &in.S3Bucket,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get object %q: %w", key, err)
+	}
+	defer out.Body.Close()
+
+	tr, closeTar, err := newTarReader(out.Body, in.Format)
+	if err != nil {
+		return nil, fmt.Errorf("open tar %q: %w", key, err)
+	}
+	defer closeTar()
+
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: %q in %q", ErrFileNotFound, entry, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read tar %q: %w", key, err)
+		}
+		if h.Typeflag != tar.TypeReg || h.Name != entry {
+			continue
+		}
+
+		n, err := io.Copy(in.Writer, tr)
+		if err != nil {
+			return nil, fmt.Errorf("copy %q in %q: %w", entry, key, err)
+		}
+		return &GetOutput{
+			Key:        key,
+			Entry:      entry,
+			Size:       n,
+			attributes: tarAttributes(h),
+		}, nil
+	}
+}
+
+// ApplyAttributes sets the modification time, permissions and ownership of the file stored in its archive to the file at name,
+// as Restore does.
+func (o *GetOutput) ApplyAttributes(name string) error {
+	return o.attributes.apply(name)
+}
+
+type partialArchive struct {
+	key  string
+	size int64
+}
+
+// listPartialArchives returns the keys and sizes of the parts of the object if it is split,
+// and of the packs of the small objects in it if it is a directory.
+// Get does not load the manifests from the metadata store, so the archives are searched in turn.
+func listPartialArchives(ctx context.Context, in *GetInput, object string) ([]partialArchive, error) {
+	var archives []partialArchive
+	for _, prefix := range []string{
+		strings.TrimSuffix(makeS3Key(in.Path, in.OutPrefix, object, in.Format), in.Format.Ext()) + ".part-",
+		path.Join(s3KeyRoot(in.Path, in.OutPrefix), object) + "/" + packKeyPrefix,
+	} {
+		err := in.S3Service.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: &in.S3Bucket,
+			Prefix: aws.String(prefix),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				k, ok := parseArchiveKey(in.Path, in.OutPrefix, *obj.Key)
+				if f, _ := formatOf(*obj.Key); ok && k.object == object && (k.part > 0 || k.pack > 0) && f == in.Format.orDefault() {
+					archives = append(archives, partialArchive{key: *obj.Key, size: aws.Int64Value(obj.Size)})
+				}
+			}
+			return lastPage
+		})
+		if err != nil {
+			return nil, fmt.Errorf("list archives of %q: %w", object, err)
+		}
+	}
+	return archives, nil
+}
+
+// headArchive returns the HeadObject response of the archive, or nil if it does not exist.
+func headArchive(ctx context.Context, s3Service s3iface.S3API, bucket, key string) (*s3.HeadObjectOutput, error) {
+	out, err := s3Service.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var rerr awserr.RequestFailure
+		if errors.As(err, &rerr) && rerr.StatusCode() == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// s3ReaderAt reads an S3 object with ranged GETs.
+type s3ReaderAt struct {
+	ctx       context.Context
+	s3Service s3iface.S3API
+	s3Bucket  string
+	key       string
+	size      int64
+
+	mu       sync.Mutex
+	buf      []byte
+	bufStart int64
+}
+
+func (r *s3ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int
+	for n < len(p) && off < r.size {
+		if off < r.bufStart || off >= r.bufStart+int64(len(r.buf)) {
+			if err := r.fetch(off, max(int64(len(p)-n), s3ReadAtBlockSize)); err != nil {
+				return n, err
+			}
+		}
+		c := copy(p[n:], r.buf[off-r.bufStart:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *s3ReaderAt) fetch(off, length int64) error {
+	end := min(off+length, r.size) - 1
+	out, err := r.s3Service.GetObjectWithContext(r.ctx, &s3.GetObjectInput{
+		Bucket: &r.s3Bucket,
+		Key:    aws.String(r.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, end)),
+	})
+	if err != nil {
+		return fmt.Errorf("get object range: %w", err)
+	}
+	defer out.Body.Close()
+
+	buf := make([]byte, end-off+1)
+	if _, err := io.ReadFull(out.Body, buf); err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+	r.buf, r.bufStart = buf, off
+	return nil
+}
@@ -0,0 +1,152 @@
+package s3zip
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGet(t *testing.T) {
+	large := make([]byte, 4*s3ReadAtBlockSize)
+	_, err := rand.Read(large)
+	require.NoError(t, err)
+
+	dir := setupTestDir(t, "target", []testFile{
+		{path: "a1.txt", content: "a1"},
+		{path: "foo/b1.txt", content: "b1"},
+		{path: "foo/large.bin", content: string(large)},
+		{path: "foo/bar/c1.txt", content: "c1"},
+	})
+
+	s3svc := newFakeS3()
+	for _, object := range []string{"a1.txt", "foo"} {
+		r := Zip(filepath.Join(dir, object))
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		s3svc.put(makeS3Key(dir, "pref", object, FormatZip), b, s3.StorageClassStandard)
+	}
+
+	get := func(t *testing.T, name string) (*GetOutput, string, error) {
+		t.Helper()
+
+		var buf bytes.Buffer
+		out, err := Get(context.Background(), &GetInput{
+			S3Bucket:  "bucket",
+			S3Service: s3svc,
+			Path:      dir,
+			OutPrefix: "pref",
+			Name:      name,
+			Writer:    &buf,
+		})
+		return out, buf.String(), err
+	}
+
+	t.Run("file object", func(t *testing.T) {
+		out, got, err := get(t, "a1.txt")
+		require.NoError(t, err)
+		assert.Equal(t, "a1", got)
+		assert.Equal(t, "pref/target/a1.txt.zip", out.Key)
+	})
+
+	t.Run("attributes", func(t *testing.T) {
+		out, got, err := get(t, "foo/b1.txt")
+		require.NoError(t, err)
+
+		name := filepath.Join(t.TempDir(), "b1.txt")
+		require.NoError(t, os.WriteFile(name, []byte(got), 0o600))
+		require.NoError(t, out.ApplyAttributes(name))
+		want, err := os.Stat(filepath.Join(dir, "foo/b1.txt"))
+		require.NoError(t, err)
+		stat, err := os.Stat(name)
+		require.NoError(t, err)
+		assert.Equal(t, want.Mode().Perm(), stat.Mode().Perm())
+		assert.WithinDuration(t, want.ModTime(), stat.ModTime(), 2*time.Second)
+	})
+
+	t.Run("entry in directory object", func(t *testing.T) {
+		s3svc.sent = 0
+		out, got, err := get(t, "foo/bar/c1.txt")
+		require.NoError(t, err)
+		assert.Equal(t, "c1", got)
+		assert.Equal(t, "pref/target/foo.zip", out.Key)
+		assert.Equal(t, "bar/c1.txt", out.Entry)
+		assert.Less(t, s3svc.sent, len(large), "the whole archive should not be downloaded")
+	})
+
+	t.Run("large entry", func(t *testing.T) {
+		_, got, err := get(t, "foo/large.bin")
+		require.NoError(t, err)
+		assert.Equal(t, string(large), got)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, _, err := get(t, "foo/none.txt")
+		require.ErrorIs(t, err, ErrFileNotFound)
+
+		_, _, err = get(t, "none/none.txt")
+		require.ErrorIs(t, err, ErrFileNotFound)
+	})
+
+	t.Run("directory holding a file of its name", func(t *testing.T) {
+		qux := setupTestDir(t, "", []testFile{{path: "qux/qux", content: "q"}})
+		r := Zip(filepath.Join(qux, "qux"))
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		key := makeS3Key(dir, "pref", "qux", FormatZip)
+		s3svc.put(key, b, s3.StorageClassStandard)
+		s3svc.objects[key].metadata = archiveUserMetadata(&Metadata{ObjectKind: objectKindDir})
+
+		_, got, err := get(t, "qux/qux")
+		require.NoError(t, err)
+		assert.Equal(t, "q", got)
+
+		_, _, err = get(t, "qux")
+		require.ErrorIs(t, err, ErrFileNotFound)
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		_, _, err := get(t, "../a1.txt")
+		require.Error(t, err)
+	})
+
+	t.Run("tar", func(t *testing.T) {
+		r := Pack(filepath.Join(dir, "foo"), PackOptions{Format: FormatTarZst})
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		s3svc.put(makeS3Key(dir, "pref", "foo", FormatTarZst), b, s3.StorageClassStandard)
+
+		var buf bytes.Buffer
+		out, err := Get(context.Background(), &GetInput{
+			S3Bucket:  "bucket",
+			S3Service: s3svc,
+			Path:      dir,
+			OutPrefix: "pref",
+			Format:    FormatTarZst,
+			Name:      "foo/bar/c1.txt",
+			Writer:    &buf,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "c1", buf.String())
+		assert.Equal(t, "pref/target/foo.tar.zst", out.Key)
+
+		_, err = Get(context.Background(), &GetInput{
+			S3Bucket:  "bucket",
+			S3Service: s3svc,
+			Path:      dir,
+			OutPrefix: "pref",
+			Format:    FormatTarZst,
+			Name:      "foo/none.txt",
+			Writer:    &buf,
+		})
+		require.ErrorIs(t, err, ErrFileNotFound)
+	})
+}
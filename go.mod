@@ -4,9 +4,11 @@ go 1.24
 
 require (
 	github.com/aws/aws-sdk-go v1.55.6
+	github.com/bmatcuk/doublestar/v4 v4.10.2
 	github.com/dustin/go-humanize v1.0.1
+	github.com/klauspost/compress v1.17.11
 	github.com/stretchr/testify v1.10.0
-	golang.org/x/mod v0.23.0
+	go.etcd.io/bbolt v1.4.3
 	golang.org/x/sync v0.11.0
 	google.golang.org/protobuf v1.36.5
 	gopkg.in/yaml.v3 v3.0.1
@@ -16,4 +18,5 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
 )
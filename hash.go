@@ -5,45 +5,165 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
+)
+
+// HashMode selects which properties of the files are used by Hash to detect changes.
+type HashMode string
 
-	"golang.org/x/mod/sumdb/dirhash"
+const (
+	// HashModeSize uses the file names and sizes. It is the default mode.
+	HashModeSize HashMode = "size"
+	// HashModeMtime uses the file names, sizes and modification times.
+	HashModeMtime HashMode = "mtime"
+	// HashModeContent uses the file names and SHA-256 of the file contents.
+	HashModeContent HashMode = "content"
 )
 
 // Hash returns a hash of the given file or directory.
-// This only uses the file size and name for performance.
-func Hash(name string) (string, error) {
-	stat, err := os.Stat(name)
+// The mode selects the file properties which are hashed, an empty mode means HashModeSize.
+// The symlink policy, the filter, the ignore files and the empty directories are taken into account as they are by Pack,
+// and the contents of the ignore files applied to the object are hashed too.
+func Hash(name string, mode HashMode, symlinks SymlinkPolicy, filter Filter) (string, error) {
+	return hash(name, mode, symlinks, filter, func(path string, _ os.FileInfo) ([]byte, error) {
+		return fileSHA256(path)
+	})
+}
+
+// hash is Hash with the SHA-256 of the files in HashModeContent computed by digest.
+func hash(name string, mode HashMode, symlinks SymlinkPolicy, filter Filter, digest func(path string, stat os.FileInfo) ([]byte, error)) (string, error) {
+	entries, ignores, err := objectEntries(name, symlinks, filter)
 	if err != nil {
-		return "", fmt.Errorf("stat: %w", err)
+		return "", err
 	}
+	return hashEntries(name, entries, ignores, mode, filter, digest)
+}
+
+// hashObject is hash, which also returns the size of the object as Size does and its newest modification time, from the same walk.
+func hashObject(name string, mode HashMode, symlinks SymlinkPolicy, filter Filter, digest func(path string, stat os.FileInfo) ([]byte, error)) (string, int, time.Time, error) {
+	entries, ignores, err := objectEntries(name, symlinks, filter)
+	if err != nil {
+		return "", 0, time.Time{}, err
+	}
+	h, err := hashEntries(name, entries, ignores, mode, filter, digest)
+	if err != nil {
+		return "", 0, time.Time{}, err
+	}
+	return h, int(entriesSize(entries)), entriesModTime(entries), nil
+}
 
-	files := []string{"."}
-	if stat.IsDir() {
-		files, err = dirhash.DirFiles(name, "")
+// hashEntries returns the hash of the object at name from its entries and ignore files returned by objectEntries.
+func hashEntries(name string, entries []walkEntry, ignores []*ignoreFile, mode HashMode, filter Filter, digest func(path string, stat os.FileInfo) ([]byte, error)) (string, error) {
+	lines, err := hashLines(name, entries, mode, digest)
+	if err != nil {
+		return "", err
+	}
+	return sumHashLines(append(ignoreLines(filter, ignores), lines...)), nil
+}
+
+// objectEntries returns the archived entries of the object at name sorted by path,
+// which are its files, links and empty directories other than itself, and the ignore files applied to it.
+func objectEntries(name string, symlinks SymlinkPolicy, filter Filter) ([]walkEntry, []*ignoreFile, error) {
+	var entries []walkEntry
+	ignores, err := walkObject(name, symlinks, filter, true, func(e walkEntry) error {
+		if e.kind == walkDir && (!e.empty || e.rel == ".") {
+			return nil
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("walk: %w", err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].rel < entries[j].rel
+	})
+	return entries, ignores, nil
+}
+
+// ignoreLines returns the hashed lines of the ignore files applied to the object of the filter, by their paths relative to the object.
+func ignoreLines(filter Filter, ignores []*ignoreFile) []string {
+	base := filter.path(".")
+	if base == "" {
+		base = "."
+	}
+	lines := make([]string, 0, len(ignores))
+	for _, f := range ignores {
+		rel, err := filepath.Rel(filepath.FromSlash(base), filepath.FromSlash(f.rel))
 		if err != nil {
-			return "", fmt.Errorf("dir files: %w", err)
+			rel = f.rel
 		}
+		lines = append(lines, fmt.Sprintf("ignore %x  %s\n", f.sum, filepath.ToSlash(rel)))
 	}
-	sort.Strings(files)
+	sort.Strings(lines)
+	return lines
+}
 
-	h := sha256.New()
-	for _, file := range files {
+// hashLines returns the hashed line of each of the sorted entries of the object at name.
+// The hash of any consecutive entries is the hash of an object of only those entries.
+func hashLines(name string, entries []walkEntry, mode HashMode, digest func(path string, stat os.FileInfo) ([]byte, error)) ([]string, error) {
+	if mode == "" {
+		mode = HashModeSize
+	}
+	if mode != HashModeSize && mode != HashModeMtime && mode != HashModeContent {
+		return nil, fmt.Errorf("unknown hash mode %q", mode)
+	}
+
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		file := e.rel
 		if strings.Contains(file, "\n") {
-			return "", errors.New("filenames with newlines are not supported")
-		}
-		s, err := os.Stat(filepath.Join(name, file))
-		if err != nil {
-			return "", err
+			return nil, errors.New("filenames with newlines are not supported")
 		}
 		if file == "." {
-			fmt.Fprintf(h, "%d  %s\n", s.Size(), filepath.Join(name, file))
-		} else {
-			fmt.Fprintf(h, "%d  %s\n", s.Size(), file)
+			file = filepath.Clean(name)
 		}
+
+		// Directories and links are written in their own formats, so the hashes of objects without them are unchanged.
+		switch {
+		case e.kind == walkDir:
+			lines[i] = fmt.Sprintf("dir  %s\n", file)
+		case e.kind == walkSymlink:
+			lines[i] = fmt.Sprintf("-> %s  %s\n", e.target, file)
+		case mode == HashModeSize:
+			lines[i] = fmt.Sprintf("%d  %s\n", e.info.Size(), file)
+		case mode == HashModeMtime:
+			lines[i] = fmt.Sprintf("%d %d  %s\n", e.info.Size(), e.info.ModTime().UnixNano(), file)
+		case mode == HashModeContent:
+			sum, err := digest(e.path, e.info)
+			if err != nil {
+				return nil, err
+			}
+			lines[i] = fmt.Sprintf("%x  %s\n", sum, file)
+		}
+	}
+	return lines, nil
+}
+
+// sumHashLines returns the hash of the lines returned by hashLines.
+func sumHashLines(lines []string) string {
+	h := sha256.New()
+	for _, l := range lines {
+		io.WriteString(h, l)
+	}
+	return "s3zip:" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func fileSHA256(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("read %q: %w", name, err)
 	}
-	return "s3zip:" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+	return h.Sum(nil), nil
 }
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -19,9 +20,9 @@ func TestHash(t *testing.T) {
 			{path: "baz/d1.txt", content: "d1"},
 		})
 
-		got, err := Hash(dir)
+		got, err := Hash(dir, HashModeSize, SymlinksFollow, Filter{})
 		require.NoError(t, err)
-		got2, err := Hash(dir)
+		got2, err := Hash(dir, HashModeSize, SymlinksFollow, Filter{})
 		require.NoError(t, err)
 		require.Equal(t, got, got2)
 
@@ -31,12 +32,12 @@ func TestHash(t *testing.T) {
 		require.NoError(t, err)
 		require.NoError(t, f.Close())
 
-		got3, err := Hash(dir)
+		got3, err := Hash(dir, HashModeSize, SymlinksFollow, Filter{})
 		require.NoError(t, err)
 		require.Equal(t, got, got3, "Hash should not change if file content is changed but its size is the same")
 
 		require.NoError(t, os.RemoveAll(filepath.Join(dir, "baz")))
-		got4, err := Hash(dir)
+		got4, err := Hash(dir, HashModeSize, SymlinksFollow, Filter{})
 		require.NoError(t, err)
 		require.NotEqual(t, got, got4, "Hash should change if file is removed")
 	})
@@ -47,10 +48,59 @@ func TestHash(t *testing.T) {
 			{path: "b1.txt", content: "same"},
 		})
 
-		got, err := Hash(filepath.Join(dir, "a1.txt"))
+		got, err := Hash(filepath.Join(dir, "a1.txt"), HashModeSize, SymlinksFollow, Filter{})
 		require.NoError(t, err)
-		got2, err := Hash(filepath.Join(dir, "b1.txt"))
+		got2, err := Hash(filepath.Join(dir, "b1.txt"), HashModeSize, SymlinksFollow, Filter{})
 		require.NoError(t, err)
 		assert.NotEqual(t, got, got2)
 	})
 }
+
+func TestHashMode(t *testing.T) {
+	dir := setupTestDir(t, "", []testFile{
+		{path: "a1.txt", content: "a1"},
+		{path: "foo/b1.txt", content: "b1"},
+	})
+
+	hashes := func(t *testing.T) map[HashMode]string {
+		t.Helper()
+
+		res := make(map[HashMode]string)
+		for _, mode := range []HashMode{HashModeSize, HashModeMtime, HashModeContent} {
+			h, err := Hash(dir, mode, SymlinksFollow, Filter{})
+			require.NoError(t, err)
+			res[mode] = h
+		}
+		return res
+	}
+
+	got := hashes(t)
+	assert.NotEqual(t, got[HashModeSize], got[HashModeMtime])
+	assert.NotEqual(t, got[HashModeSize], got[HashModeContent])
+
+	empty, err := Hash(dir, "", SymlinksFollow, Filter{})
+	require.NoError(t, err)
+	assert.Equal(t, got[HashModeSize], empty, "empty mode should be size mode")
+
+	_, err = Hash(dir, "unknown", SymlinksFollow, Filter{})
+	require.Error(t, err)
+
+	t.Run("same size content change", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "foo/b1.txt"), []byte("bb"), 0644))
+		require.NoError(t, os.Chtimes(filepath.Join(dir, "foo/b1.txt"), time.Now(), time.Now().Add(time.Hour)))
+
+		got2 := hashes(t)
+		assert.Equal(t, got[HashModeSize], got2[HashModeSize])
+		assert.NotEqual(t, got[HashModeMtime], got2[HashModeMtime])
+		assert.NotEqual(t, got[HashModeContent], got2[HashModeContent])
+		got = got2
+	})
+
+	t.Run("touch", func(t *testing.T) {
+		require.NoError(t, os.Chtimes(filepath.Join(dir, "foo/b1.txt"), time.Now(), time.Now().Add(2*time.Hour)))
+
+		got2 := hashes(t)
+		assert.NotEqual(t, got[HashModeMtime], got2[HashModeMtime])
+		assert.Equal(t, got[HashModeContent], got2[HashModeContent])
+	})
+}
@@ -0,0 +1,305 @@
+package s3zip
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultHashCacheName is the file name of the hash cache, which is placed beside the config file by default.
+const DefaultHashCacheName = "s3zip-cache.db"
+
+var (
+	hashCacheObjectsBucket = []byte("objects")
+	hashCacheFilesBucket   = []byte("files")
+)
+
+// HashCache is an on-disk cache of the hashes of local objects in HashModeContent, so that unchanged files are not read on every run.
+//
+// A cached hash is used while the fingerprint of its object is unchanged, which is the inode numbers, sizes and modification times
+// of its files. The files are still walked and stat'ed, so the cache does not help the other hash modes, which only hash the stat results.
+// The SHA-256 of each file is cached too, and reused while its inode number, size and modification time are unchanged.
+type HashCache struct {
+	db *bbolt.DB
+
+	mu sync.Mutex
+	// used are the keys of the objects hashed since the cache was opened, the others are removed by prune.
+	used map[string]bool
+}
+
+// OpenHashCache opens the hash cache file, creating it if it does not exist.
+// The file is locked until Close, so a cache cannot be shared by concurrent runs.
+func OpenHashCache(name string) (*HashCache, error) {
+	db, err := bbolt.Open(name, 0o600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open %q: %w", name, err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, b := range [][]byte{hashCacheObjectsBucket, hashCacheFilesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create buckets: %w", err)
+	}
+	return &HashCache{db: db, used: make(map[string]bool)}, nil
+}
+
+func (c *HashCache) Close() error {
+	return c.db.Close()
+}
+
+// hash returns the hash, size and newest modification time of the object at name, from a single walk.
+// In HashModeContent the hash is taken from the cache if the fingerprint of the object is unchanged, otherwise the cached SHA-256
+// of its unchanged files are reused. The other modes hash the stat results of the walk, which cost as much as a fingerprint,
+// so they do not use the cache. If rehash is true, the cached hashes are ignored but the cache is still updated.
+func (c *HashCache) hash(name string, mode HashMode, symlinks SymlinkPolicy, filter Filter, rehash bool) (string, int, time.Time, error) {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return "", 0, time.Time{}, err
+	}
+	// The files are stat'ed before they are read, so that changes made during hashing are detected by the next run.
+	entries, ignores, err := objectEntries(name, symlinks, filter)
+	if err != nil {
+		return "", 0, time.Time{}, err
+	}
+	size, modified := int(entriesSize(entries)), entriesModTime(entries)
+	if mode != HashModeContent {
+		h, err := hashEntries(name, entries, ignores, mode, filter, nil)
+		return h, size, modified, err
+	}
+
+	key := []byte(string(mode) + "\x00" + string(symlinks.orDefault()) + "\x00" + name)
+	if !filter.selectsAll() {
+		// The keys without a filter are unchanged, to keep the caches from before filters.
+		key = append(key, "\x00"+filter.String()...)
+	}
+	c.mu.Lock()
+	c.used[string(key)] = true
+	c.mu.Unlock()
+
+	fp := fingerprint(entries, ignores)
+	if !rehash {
+		var cached HashCacheObject
+		ok, err := c.get(hashCacheObjectsBucket, key, &cached)
+		if err != nil {
+			return "", 0, time.Time{}, err
+		}
+		if ok && bytes.Equal(cached.Fingerprint, fp) {
+			return cached.Hash, size, modified, nil
+		}
+	}
+
+	files := make(map[string]*HashCacheFile)
+	h, err := hashEntries(name, entries, ignores, mode, filter, func(path string, stat os.FileInfo) ([]byte, error) {
+		f := &HashCacheFile{
+			Inode:    inode(stat),
+			Size:     stat.Size(),
+			Modified: stat.ModTime().UnixNano(),
+		}
+
+		if !rehash {
+			sum, ok, err := c.cachedFileSHA256(path, f)
+			if err != nil || ok {
+				return sum, err
+			}
+		}
+
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return nil, err
+		}
+		f.Sha256 = sum
+		files[path] = f
+		return sum, nil
+	})
+	if err != nil {
+		return "", 0, time.Time{}, err
+	}
+
+	current := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		current[e.path] = true
+	}
+	err = c.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(hashCacheFilesBucket)
+		// The files removed from the object are removed from the cache.
+		if err := deletePrefix(b, name+string(filepath.Separator), func(path string) bool { return !current[path] }); err != nil {
+			return err
+		}
+		for path, f := range files {
+			if err := putProto(b, []byte(path), f); err != nil {
+				return err
+			}
+		}
+		return putProto(tx.Bucket(hashCacheObjectsBucket), key, &HashCacheObject{
+			Fingerprint: fp,
+			Hash:        h,
+			Size:        int64(size),
+		})
+	})
+	if err != nil {
+		return "", 0, time.Time{}, fmt.Errorf("update hash cache: %w", err)
+	}
+	return h, size, modified, nil
+}
+
+// prune removes the cached hashes of the objects under root which have not been hashed since the cache was opened,
+// and the cached SHA-256 of the files of those which no longer exist.
+func (c *HashCache) prune(root string) (int, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int
+	err = c.db.Update(func(tx *bbolt.Tx) error {
+		objects, files := tx.Bucket(hashCacheObjectsBucket), tx.Bucket(hashCacheFilesBucket)
+		var removed []string
+		err := deletePrefix(objects, "", func(key string) bool {
+			// The keys are the hash mode, the symlink policy, the path and optionally the filter, separated by NUL.
+			fields := strings.Split(key, "\x00")
+			if len(fields) < 3 || c.used[key] || !under(root, fields[2]) {
+				return false
+			}
+			if _, err := os.Lstat(fields[2]); errors.Is(err, fs.ErrNotExist) {
+				removed = append(removed, fields[2])
+			}
+			n++
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range removed {
+			if err := files.Delete([]byte(name)); err != nil {
+				return err
+			}
+			if err := deletePrefix(files, name+string(filepath.Separator), func(string) bool { return true }); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("prune hash cache: %w", err)
+	}
+	return n, nil
+}
+
+// under reports whether the path is root or in it.
+func under(root, path string) bool {
+	return path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// deletePrefix deletes the keys of the bucket starting with prefix for which del returns true.
+func deletePrefix(b *bbolt.Bucket, prefix string, del func(key string) bool) error {
+	// The keys are deleted after the iteration, which a deletion would disturb.
+	var keys []string
+	c := b.Cursor()
+	for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+		if del(string(k)) {
+			keys = append(keys, string(k))
+		}
+	}
+	for _, k := range keys {
+		if err := b.Delete([]byte(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileSHA256 returns the SHA-256 of the file, from the cache if the file is unchanged. Computed hashes are not cached.
+func (c *HashCache) fileSHA256(path string, stat os.FileInfo) ([]byte, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	sum, ok, err := c.cachedFileSHA256(path, &HashCacheFile{
+		Inode:    inode(stat),
+		Size:     stat.Size(),
+		Modified: stat.ModTime().UnixNano(),
+	})
+	if err != nil || ok {
+		return sum, err
+	}
+	return fileSHA256(path)
+}
+
+// cachedFileSHA256 returns the cached SHA-256 of the file at the absolute path, if its stat results f are unchanged.
+func (c *HashCache) cachedFileSHA256(path string, f *HashCacheFile) ([]byte, bool, error) {
+	var cached HashCacheFile
+	ok, err := c.get(hashCacheFilesBucket, []byte(path), &cached)
+	if err != nil {
+		return nil, false, err
+	}
+	if ok && cached.Inode == f.Inode && cached.Size == f.Size && cached.Modified == f.Modified {
+		return cached.Sha256, true, nil
+	}
+	return nil, false, nil
+}
+
+// get reads the cached message of key into m, and reports whether it exists.
+func (c *HashCache) get(bucket, key []byte, m proto.Message) (bool, error) {
+	var ok bool
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucket).Get(key)
+		if b == nil {
+			return nil
+		}
+		ok = true
+		return proto.Unmarshal(b, m)
+	})
+	if err != nil {
+		return false, fmt.Errorf("read hash cache: %w", err)
+	}
+	return ok, nil
+}
+
+// putProto writes m to key of the bucket.
+func putProto(b *bbolt.Bucket, key []byte, m proto.Message) error {
+	v, err := proto.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	return b.Put(key, v)
+}
+
+// fingerprint returns a digest of the properties of the entries of an object which are compared by HashCache,
+// which are the inode numbers, sizes and modification times of its files, its links and empty directories,
+// and the contents of the ignore files applied to it.
+func fingerprint(entries []walkEntry, ignores []*ignoreFile) []byte {
+	h := sha256.New()
+	for _, e := range entries {
+		switch e.kind {
+		case walkFile:
+			fmt.Fprintf(h, "%d %d %d  %s\n", inode(e.info), e.info.Size(), e.info.ModTime().UnixNano(), e.rel)
+		case walkSymlink:
+			fmt.Fprintf(h, "-> %s  %s\n", e.target, e.rel)
+		case walkDir:
+			fmt.Fprintf(h, "dir  %s\n", e.rel)
+		}
+	}
+	for _, f := range ignores {
+		fmt.Fprintf(h, "ignore %x  %s\n", f.sum, f.rel)
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,174 @@
+package s3zip
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestHashCache opens a hash cache in a temporary directory, which is closed at the end of the test.
+func newTestHashCache(t *testing.T) *HashCache {
+	t.Helper()
+
+	c, err := OpenHashCache(filepath.Join(t.TempDir(), DefaultHashCacheName))
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestHashCache(t *testing.T) {
+	for _, mode := range []HashMode{HashModeSize, HashModeMtime, HashModeContent} {
+		t.Run(string(mode), func(t *testing.T) {
+			c := newTestHashCache(t)
+			dir := setupTestDir(t, "target", []testFile{
+				{path: "a1.txt", content: "a1"},
+				{path: "foo/b1.txt", content: "b1"},
+			})
+
+			want, err := Hash(dir, mode, SymlinksFollow, Filter{})
+			require.NoError(t, err)
+			got, size, _, err := c.hash(dir, mode, SymlinksFollow, Filter{}, false)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+			assert.Equal(t, 4, size)
+
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "foo/b2.txt"), []byte("b2"), 0o644))
+
+			want, err = Hash(dir, mode, SymlinksFollow, Filter{})
+			require.NoError(t, err)
+			got, size, _, err = c.hash(dir, mode, SymlinksFollow, Filter{}, false)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+			assert.Equal(t, 6, size)
+		})
+	}
+
+	t.Run("unchanged directories", func(t *testing.T) {
+		for _, mode := range []HashMode{HashModeSize, HashModeContent} {
+			c := newTestHashCache(t)
+			dir := setupTestDir(t, "target", []testFile{
+				{path: "foo/b1.txt", content: "b1"},
+			})
+			name := filepath.Join(dir, "foo/b1.txt")
+			stat, err := os.Stat(name)
+			require.NoError(t, err)
+
+			old, _, _, err := c.hash(dir, mode, SymlinksFollow, Filter{}, false)
+			require.NoError(t, err)
+
+			// Rewriting a file in place does not change the modification time of its directory, but of the file.
+			require.NoError(t, os.WriteFile(name, []byte("b1b1"), 0o644))
+			require.NoError(t, os.Chtimes(name, time.Time{}, stat.ModTime().Add(time.Second)))
+			want, err := Hash(dir, mode, SymlinksFollow, Filter{})
+			require.NoError(t, err)
+			require.NotEqual(t, old, want)
+
+			got, size, _, err := c.hash(dir, mode, SymlinksFollow, Filter{}, false)
+			require.NoError(t, err)
+			assert.Equal(t, want, got, mode)
+			assert.Equal(t, 4, size, mode)
+		}
+	})
+
+	t.Run("rehash", func(t *testing.T) {
+		c := newTestHashCache(t)
+		dir := setupTestDir(t, "target", []testFile{
+			{path: "foo/b1.txt", content: "b1"},
+		})
+		name := filepath.Join(dir, "foo/b1.txt")
+		stat, err := os.Stat(name)
+		require.NoError(t, err)
+
+		old, _, _, err := c.hash(dir, HashModeContent, SymlinksFollow, Filter{}, false)
+		require.NoError(t, err)
+
+		// A file rewritten with the same size and modification time is only detected by hashing again.
+		require.NoError(t, os.WriteFile(name, []byte("b2"), 0o644))
+		require.NoError(t, os.Chtimes(name, time.Time{}, stat.ModTime()))
+		want, err := Hash(dir, HashModeContent, SymlinksFollow, Filter{})
+		require.NoError(t, err)
+		require.NotEqual(t, old, want)
+
+		got, _, _, err := c.hash(dir, HashModeContent, SymlinksFollow, Filter{}, false)
+		require.NoError(t, err)
+		assert.Equal(t, old, got, "the cached hash should be used")
+
+		got, _, _, err = c.hash(dir, HashModeContent, SymlinksFollow, Filter{}, true)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, "rehash should ignore the cache")
+
+		got, _, _, err = c.hash(dir, HashModeContent, SymlinksFollow, Filter{}, false)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, "rehash should update the cache")
+	})
+
+	t.Run("file", func(t *testing.T) {
+		c := newTestHashCache(t)
+		dir := setupTestDir(t, "", []testFile{
+			{path: "a1.txt", content: "a1"},
+		})
+		name := filepath.Join(dir, "a1.txt")
+
+		_, _, _, err := c.hash(name, HashModeContent, SymlinksFollow, Filter{}, false)
+		require.NoError(t, err)
+
+		require.NoError(t, os.WriteFile(name, []byte("a2"), 0o644))
+		require.NoError(t, os.Chtimes(name, time.Time{}, time.Now().Add(time.Hour)))
+		want, err := Hash(name, HashModeContent, SymlinksFollow, Filter{})
+		require.NoError(t, err)
+		got, _, _, err := c.hash(name, HashModeContent, SymlinksFollow, Filter{}, false)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		name := filepath.Join(t.TempDir(), DefaultHashCacheName)
+		c, err := OpenHashCache(name)
+		require.NoError(t, err)
+		dir := setupTestDir(t, "target", []testFile{
+			{path: "foo/b1.txt", content: "b1"},
+			{path: "bar/c1.txt", content: "c1"},
+		})
+		for _, object := range []string{"foo", "bar"} {
+			_, _, _, err := c.hash(filepath.Join(dir, object), HashModeContent, SymlinksFollow, Filter{}, false)
+			require.NoError(t, err)
+		}
+		require.NoError(t, c.Close())
+
+		require.NoError(t, os.RemoveAll(filepath.Join(dir, "bar")))
+		c, err = OpenHashCache(name)
+		require.NoError(t, err)
+		defer c.Close()
+		_, _, _, err = c.hash(filepath.Join(dir, "foo"), HashModeContent, SymlinksFollow, Filter{}, false)
+		require.NoError(t, err)
+		n, err := c.prune(dir)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		var cached HashCacheFile
+		ok, err := c.get(hashCacheFilesBucket, []byte(filepath.Join(dir, "bar/c1.txt")), &cached)
+		require.NoError(t, err)
+		assert.False(t, ok, "the files of removed objects should be pruned")
+		ok, err = c.get(hashCacheFilesBucket, []byte(filepath.Join(dir, "foo/b1.txt")), &cached)
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		n, err = c.prune(dir)
+		require.NoError(t, err)
+		assert.Equal(t, 0, n)
+	})
+
+	t.Run("locked", func(t *testing.T) {
+		name := filepath.Join(t.TempDir(), DefaultHashCacheName)
+		c, err := OpenHashCache(name)
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, err = OpenHashCache(name)
+		assert.Error(t, err, "the cache should not be shared by concurrent runs")
+	})
+}
@@ -0,0 +1,162 @@
+package s3zip
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// IgnoreFileName is the name of the files which list the files not to archive in their directories, in the gitignore syntax.
+const IgnoreFileName = ".s3zipignore"
+
+// ignorePattern is a line of an ignore file.
+type ignorePattern struct {
+	glob string
+	// negate re-includes the matching files.
+	negate bool
+	// dirOnly only matches directories.
+	dirOnly bool
+	// anchored matches the paths relative to the directory of the ignore file, otherwise the base names.
+	anchored bool
+}
+
+// parseIgnoreFile parses the lines of an ignore file as gitignore does.
+func parseIgnoreFile(b []byte) ([]ignorePattern, error) {
+	var patterns []ignorePattern
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSuffix(s.Text(), "\r")
+		if !strings.HasSuffix(line, "\\ ") {
+			line = strings.TrimRight(line, " ")
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var p ignorePattern
+		if strings.HasPrefix(line, "!") {
+			p.negate, line = true, line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		// A slash at the beginning or in the middle anchors the pattern to the directory of the ignore file.
+		if strings.Contains(line, "/") {
+			p.anchored, line = true, strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		if !doublestar.ValidatePattern(line) {
+			return nil, fmt.Errorf("pattern %q: %w", s.Text(), doublestar.ErrBadPattern)
+		}
+		p.glob = line
+		patterns = append(patterns, p)
+	}
+	return patterns, s.Err()
+}
+
+// match reports whether the pattern matches the path relative to the directory of the ignore file.
+func (p ignorePattern) match(rel string, dir bool) bool {
+	if p.dirOnly && !dir {
+		return false
+	}
+	if !p.anchored {
+		rel = path.Base(rel)
+	}
+	ok, _ := doublestar.Match(p.glob, rel)
+	return ok
+}
+
+// ignoreFile is a loaded ignore file.
+type ignoreFile struct {
+	// rel is the slash-separated path of the file relative to the target.
+	rel string
+	// sum is the SHA-256 of its content.
+	sum      [sha256.Size]byte
+	patterns []ignorePattern
+}
+
+// ignoreMatcher matches the paths of a target against its ignore files, which are loaded on demand.
+type ignoreMatcher struct {
+	root string
+	// dirs are the ignore files by their directories relative to root, "." for root itself, nil if there is none.
+	dirs map[string]*ignoreFile
+	// files are the loaded ignore files in the loading order.
+	files []*ignoreFile
+}
+
+func newIgnoreMatcher(root string) *ignoreMatcher {
+	return &ignoreMatcher{root: root, dirs: make(map[string]*ignoreFile)}
+}
+
+// ignored reports whether the file or directory at the slash-separated path relative to root is ignored
+// by the ignore files of its ancestors. The last matching pattern wins, and the deeper ignore files are matched last.
+func (m *ignoreMatcher) ignored(rel string, dir bool) (bool, error) {
+	if rel == "." {
+		return false, nil
+	}
+	var ancestors []string
+	for d := path.Dir(rel); ; d = path.Dir(d) {
+		ancestors = append(ancestors, d)
+		if d == "." {
+			break
+		}
+	}
+
+	ignored := false
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		f, err := m.load(ancestors[i])
+		if err != nil {
+			return false, err
+		}
+		if f == nil {
+			continue
+		}
+		sub := rel
+		if ancestors[i] != "." {
+			sub = strings.TrimPrefix(rel, ancestors[i]+"/")
+		}
+		for _, p := range f.patterns {
+			if p.match(sub, dir) {
+				ignored = !p.negate
+			}
+		}
+	}
+	return ignored, nil
+}
+
+// load returns the ignore file in the directory at the slash-separated path relative to root, nil if there is none.
+func (m *ignoreMatcher) load(dir string) (*ignoreFile, error) {
+	if f, ok := m.dirs[dir]; ok {
+		return f, nil
+	}
+	rel := path.Join(dir, IgnoreFileName)
+	b, err := os.ReadFile(filepath.Join(m.root, filepath.FromSlash(rel)))
+	if errors.Is(err, fs.ErrNotExist) {
+		m.dirs[dir] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read ignore file: %w", err)
+	}
+	patterns, err := parseIgnoreFile(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse ignore file %q: %w", rel, err)
+	}
+	f := &ignoreFile{rel: rel, sum: sha256.Sum256(b), patterns: patterns}
+	m.dirs[dir] = f
+	m.files = append(m.files, f)
+	return f, nil
+}
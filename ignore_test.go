@@ -0,0 +1,85 @@
+package s3zip
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnoreFiles(t *testing.T) {
+	dir := setupTestDir(t, "", []testFile{
+		{path: ".s3zipignore", content: "# comment\n*.tmp\n/build/\ncache/\n!keep.tmp\n"},
+		{path: "a.tmp", content: "a"},
+		{path: "keep.tmp", content: "k"},
+		{path: "build/out.bin", content: "o"},
+		{path: "foo/build/b.txt", content: "b"},
+		{path: "foo/cache/c.txt", content: "c"},
+		{path: "foo/cache.txt", content: "c"},
+		{path: "foo/.s3zipignore", content: "*.log\n/sub/x.txt\n"},
+		{path: "foo/d.log", content: "d"},
+		{path: "foo/sub/x.txt", content: "x"},
+		{path: "foo/sub/y.txt", content: "y"},
+	})
+	rels := func(t *testing.T, name string, filter Filter) []string {
+		t.Helper()
+		entries, _, err := objectEntries(name, SymlinksFollow, filter)
+		require.NoError(t, err)
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.rel)
+		}
+		return got
+	}
+
+	t.Run("entries", func(t *testing.T) {
+		assert.Equal(t, []string{
+			".s3zipignore",
+			"foo/.s3zipignore",
+			"foo/build/b.txt",
+			"foo/cache.txt",
+			"foo/sub/y.txt",
+			"keep.tmp",
+		}, rels(t, dir, Filter{}), "the patterns should be negated, anchored and matched against directories only")
+	})
+
+	t.Run("ancestors", func(t *testing.T) {
+		assert.Equal(t, []string{".s3zipignore", "build/b.txt", "cache.txt", "sub/y.txt"},
+			rels(t, filepath.Join(dir, "foo"), Filter{}.under("foo")), "the ignore files of the ancestors should apply to an object")
+
+		got, err := LocalObjects(dir, 2, nil, SymlinksFollow, Filter{})
+		require.NoError(t, err)
+		sort.Strings(got)
+		assert.Equal(t, []string{"foo/build", "foo/cache.txt", "foo/sub", "keep.tmp"}, got, "the ignore files should not be objects")
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		name := filepath.Join(dir, "foo")
+		before, err := Hash(name, HashModeSize, SymlinksFollow, Filter{}.under("foo"))
+		require.NoError(t, err)
+
+		// The same size, so only the content of the ignore file changes.
+		require.NoError(t, os.WriteFile(filepath.Join(dir, ".s3zipignore"), []byte("# COMMENT\n*.tmp\n/build/\ncache/\n!keep.tmp\n"), 0o644))
+		after, err := Hash(name, HashModeSize, SymlinksFollow, Filter{}.under("foo"))
+		require.NoError(t, err)
+		assert.NotEqual(t, before, after, "editing the ignore file of an ancestor should change the hash")
+	})
+}
+
+func TestParseIgnoreFile(t *testing.T) {
+	got, err := parseIgnoreFile([]byte("a\n\n# c\n\\#b\n!c/\n/d/e  \nf\\ \n"))
+	require.NoError(t, err)
+	assert.Equal(t, []ignorePattern{
+		{glob: "a"},
+		{glob: "#b"},
+		{glob: "c", negate: true, dirOnly: true},
+		{glob: "d/e", anchored: true},
+		{glob: `f\ `},
+	}, got)
+
+	_, err = parseIgnoreFile([]byte("[a\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,92 @@
+package s3zip
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+type (
+	// ArchiveMetadata is an archive recorded in the metadata store.
+	ArchiveMetadata struct {
+		Key    string
+		Object string
+		// PartNumber is the number of the part if the object is split into parts, otherwise 0.
+		PartNumber int
+		// PackNumber is the number of the pack if the archive is a pack of the small objects in the directory Object, otherwise 0.
+		PackNumber int
+		*Metadata
+	}
+
+	// FoundFile is a file found in the manifest of an archive.
+	FoundFile struct {
+		Key string
+		// Path is the slash-separated path of the file relative to the target.
+		Path  string
+		Entry *Entry
+	}
+)
+
+// ListArchives returns the archives of the local path recorded in the metadata store, sorted by key.
+func ListArchives(s *MetadataStore, localPath, outPrefix string) []ArchiveMetadata {
+	res := make([]ArchiveMetadata, 0)
+	for key, m := range s.Metadata {
+		k, ok := parseArchiveKey(localPath, outPrefix, key)
+		if !ok {
+			continue
+		}
+		res = append(res, ArchiveMetadata{
+			Key:        key,
+			Object:     k.object,
+			PartNumber: k.part,
+			PackNumber: k.pack,
+			Metadata:   m,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key < res[j].Key
+	})
+	return res
+}
+
+// Files returns the files of the archive with their paths relative to the target.
+func (a ArchiveMetadata) Files() []FoundFile {
+	names := make([]string, len(a.Entries))
+	for i, e := range a.Entries {
+		names[i] = e.Name
+	}
+	dir := objectDir(a.Object, a.PartNumber != 0 || a.PackNumber != 0, a.ObjectKind, names)
+
+	res := make([]FoundFile, len(a.Entries))
+	for i, e := range a.Entries {
+		res[i] = FoundFile{
+			Key:   a.Key,
+			Path:  path.Join(dir, e.Name),
+			Entry: e,
+		}
+	}
+	return res
+}
+
+// FindFiles returns the files of the local path recorded in the metadata store which match the glob pattern.
+// A pattern containing a slash is matched against the path relative to the target, otherwise against the base name.
+func FindFiles(s *MetadataStore, localPath, outPrefix, pattern string) ([]FoundFile, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+
+	res := make([]FoundFile, 0)
+	for _, a := range ListArchives(s, localPath, outPrefix) {
+		for _, f := range a.Files() {
+			name := f.Path
+			if !strings.Contains(pattern, "/") {
+				name = path.Base(name)
+			}
+			if ok, _ := path.Match(pattern, name); ok {
+				res = append(res, f)
+			}
+		}
+	}
+	return res, nil
+}
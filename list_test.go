@@ -0,0 +1,65 @@
+package s3zip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindFiles(t *testing.T) {
+	store := &MetadataStore{
+		Metadata: map[string]*Metadata{
+			"pref/target/a1.txt.zip": {
+				Entries: []*Entry{{Name: "a1.txt"}},
+			},
+			"pref/target/foo.zip": {
+				Entries: []*Entry{{Name: "b1.txt"}, {Name: "bar/c1.txt"}},
+			},
+			"pref/target/2019/trip.zip": {
+				Entries: []*Entry{{Name: "IMG_0042.jpg"}, {Name: "IMG_0043.jpg"}},
+			},
+			"pref/target/qux.zip": {
+				Entries:    []*Entry{{Name: "qux"}},
+				ObjectKind: objectKindDir,
+			},
+			"pref/other/x.zip": {
+				Entries: []*Entry{{Name: "b1.txt"}},
+			},
+		},
+	}
+
+	archives := ListArchives(store, "/path/to/target", "pref")
+	keys := make([]string, len(archives))
+	for i, a := range archives {
+		keys[i] = a.Key
+	}
+	assert.Equal(t, []string{"pref/target/2019/trip.zip", "pref/target/a1.txt.zip", "pref/target/foo.zip", "pref/target/qux.zip"}, keys)
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{pattern: "a1.txt", want: []string{"a1.txt"}},
+		{pattern: "*1.txt", want: []string{"a1.txt", "foo/b1.txt", "foo/bar/c1.txt"}},
+		{pattern: "foo/*", want: []string{"foo/b1.txt"}},
+		{pattern: "2019/trip/IMG_0042.jpg", want: []string{"2019/trip/IMG_0042.jpg"}},
+		{pattern: "IMG_*", want: []string{"2019/trip/IMG_0042.jpg", "2019/trip/IMG_0043.jpg"}},
+		{pattern: "qux", want: []string{"qux/qux"}},
+		{pattern: "none", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			files, err := FindFiles(store, "/path/to/target", "pref", tt.pattern)
+			require.NoError(t, err)
+			got := make([]string, len(files))
+			for i, f := range files {
+				got[i] = f.Path
+			}
+			assert.ElementsMatch(t, tt.want, got)
+		})
+	}
+
+	_, err := FindFiles(store, "/path/to/target", "pref", "[")
+	require.Error(t, err)
+}
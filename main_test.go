@@ -1,10 +1,28 @@
 package s3zip
 
 import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/stretchr/testify/require"
 )
 
@@ -40,3 +58,331 @@ func setupTestDir(t *testing.T, prefix string, files []testFile) string {
 
 	return tmpDir
 }
+
+// setupTestBucket creates a bucket on the local MinIO and returns the S3 client and the bucket name.
+// All objects in the bucket and the bucket itself are removed on cleanup.
+func setupTestBucket(t *testing.T) (*s3.S3, string) {
+	t.Helper()
+
+	bucketName := fmt.Sprintf("s3zip-test-%d", time.Now().UnixNano())
+	s3svc := s3.New(session.Must(session.NewSession()), &aws.Config{
+		Endpoint:         aws.String("http://localhost:9000"),
+		Region:           aws.String("ap-northeast-1"),
+		Credentials:      credentials.NewStaticCredentials("minioadmin", "minioadmin", ""),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	_, err := s3svc.CreateBucket(&s3.CreateBucketInput{
+		Bucket: aws.String(bucketName),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		keys := make([]*string, 0)
+		require.NoError(t, s3svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: aws.String(bucketName),
+		}, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range output.Contents {
+				keys = append(keys, object.Key)
+			}
+			return lastPage
+		}))
+		for _, key := range keys {
+			_, err := s3svc.DeleteObject(&s3.DeleteObjectInput{
+				Bucket: aws.String(bucketName),
+				Key:    key,
+			})
+			require.NoError(t, err, "delete object %q", *key)
+		}
+		_, err := s3svc.DeleteBucket(&s3.DeleteBucketInput{
+			Bucket: aws.String(bucketName),
+		})
+		require.NoError(t, err)
+	})
+
+	return s3svc, bucketName
+}
+
+// fakeS3 is an in-memory S3 which simulates the restore of archived objects.
+// Only the operations used by s3zip are implemented, calling others panics.
+type fakeS3 struct {
+	s3iface.S3API
+
+	mu      sync.Mutex
+	objects map[string]*fakeS3Object
+	uploads map[string]*fakeS3Upload // multipart uploads by ID
+	sent    int                      // bytes sent by GetObject
+	copied  int                      // bytes copied by CopyObject and UploadPartCopy
+
+	// beforePut is called with the key of each object put by PutObject after its body has been read, if it is not nil.
+	beforePut func(key string)
+}
+
+type fakeS3Object struct {
+	body         []byte
+	etag         string
+	storageClass string
+	metadata     map[string]*string
+	restore      string // value of the x-amz-restore header
+}
+
+// archived reports whether the object cannot be read until it is restored.
+func (o *fakeS3Object) archived() bool {
+	return o.storageClass == s3.StorageClassDeepArchive && !strings.Contains(o.restore, `ongoing-request="false"`)
+}
+
+type fakeS3Upload struct {
+	key          string
+	storageClass string
+	metadata     map[string]*string
+	parts        map[int64][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string]*fakeS3Object),
+		uploads: make(map[string]*fakeS3Upload),
+	}
+}
+
+func (f *fakeS3) put(key string, body []byte, storageClass string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.putLocked(key, body, storageClass)
+}
+
+func (f *fakeS3) putLocked(key string, body []byte, storageClass string) string {
+	etag := fmt.Sprintf(`"%x"`, md5.Sum(body))
+	f.objects[key] = &fakeS3Object{body: body, etag: etag, storageClass: storageClass}
+	return etag
+}
+
+// completeRestore finishes the ongoing restore of the object.
+func (f *fakeS3) completeRestore(key string, expiry time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key].restore = fmt.Sprintf(`ongoing-request="false", expiry-date="%s"`, expiry.UTC().Format(http.TimeFormat))
+}
+
+func (f *fakeS3) ListObjectsV2PagesWithContext(_ aws.Context, in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+	f.mu.Lock()
+	out := &s3.ListObjectsV2Output{}
+	for key, obj := range f.objects {
+		if strings.HasPrefix(key, aws.StringValue(in.Prefix)) {
+			out.Contents = append(out.Contents, &s3.Object{
+				Key:          aws.String(key),
+				Size:         aws.Int64(int64(len(obj.body))),
+				StorageClass: aws.String(obj.storageClass),
+			})
+		}
+	}
+	f.mu.Unlock()
+
+	sort.Slice(out.Contents, func(i, j int) bool {
+		return *out.Contents[i].Key < *out.Contents[j].Key
+	})
+	fn(out, true)
+	return nil
+}
+
+func (f *fakeS3) GetObjectWithContext(_ aws.Context, in *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, ok := f.objects[*in.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	if obj.archived() {
+		return nil, awserr.New(s3.ErrCodeInvalidObjectState, "object is archived", nil)
+	}
+
+	body := obj.body
+	if in.Range != nil {
+		var start, end int
+		if _, err := fmt.Sscanf(*in.Range, "bytes=%d-%d", &start, &end); err != nil {
+			return nil, err
+		}
+		body = body[start:min(end+1, len(body))]
+	}
+	f.sent += len(body)
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: aws.Int64(int64(len(body))),
+		ETag:          aws.String(obj.etag),
+	}, nil
+}
+
+// PutObjectWithContext supports the If-Match and If-None-Match preconditions.
+func (f *fakeS3) PutObjectWithContext(_ aws.Context, in *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	b, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	if f.beforePut != nil {
+		f.beforePut(*in.Key)
+	}
+
+	r := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}}
+	r.ApplyOptions(opts...)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, exists := f.objects[*in.Key]
+	ifMatch, ifNoneMatch := r.HTTPRequest.Header.Get("If-Match"), r.HTTPRequest.Header.Get("If-None-Match")
+	if (ifMatch != "" && (!exists || obj.etag != ifMatch)) || (ifNoneMatch == "*" && exists) {
+		return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "precondition failed", nil), http.StatusPreconditionFailed, "")
+	}
+
+	etag := f.putLocked(*in.Key, b, aws.StringValue(in.StorageClass))
+	f.objects[*in.Key].metadata = in.Metadata
+	return &s3.PutObjectOutput{ETag: aws.String(etag)}, nil
+}
+
+func (f *fakeS3) HeadObjectWithContext(_ aws.Context, in *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, ok := f.objects[*in.Key]
+	if !ok {
+		return nil, awserr.NewRequestFailure(awserr.New("NotFound", "not found", nil), http.StatusNotFound, "")
+	}
+	out := &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(obj.body))),
+		ETag:          aws.String(obj.etag),
+		Metadata:      obj.metadata,
+	}
+	if obj.storageClass != s3.StorageClassStandard {
+		out.StorageClass = aws.String(obj.storageClass)
+	}
+	if obj.restore != "" {
+		out.Restore = aws.String(obj.restore)
+	}
+	return out, nil
+}
+
+func (f *fakeS3) RestoreObjectWithContext(_ aws.Context, in *s3.RestoreObjectInput, _ ...request.Option) (*s3.RestoreObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, ok := f.objects[*in.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	if obj.restore == `ongoing-request="true"` {
+		return nil, awserr.NewRequestFailure(awserr.New("RestoreAlreadyInProgress", "restore is in progress", nil), http.StatusConflict, "")
+	}
+	obj.restore = `ongoing-request="true"`
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+// PutObjectRequest is used by s3manager.Uploader for small objects.
+func (f *fakeS3) PutObjectRequest(in *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	out := &s3.PutObjectOutput{}
+	r := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{Name: "PutObject"}, in, out)
+	r.Handlers.Send.PushBack(func(r *request.Request) {
+		o, err := f.PutObjectWithContext(r.Context(), in)
+		if err != nil {
+			r.Error = err
+			return
+		}
+		*out = *o
+	})
+	return r, out
+}
+
+func (f *fakeS3) DeleteObjectsWithContext(_ aws.Context, in *s3.DeleteObjectsInput, _ ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, obj := range in.Delete.Objects {
+		delete(f.objects, *obj.Key)
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+// source returns the object of a copy source, which fails if the object is archived.
+func (f *fakeS3) source(copySource string) (*fakeS3Object, error) {
+	_, key, _ := strings.Cut(copySource, "/")
+	key, err := url.PathUnescape(key)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := f.objects[key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	if obj.archived() {
+		return nil, awserr.New(s3.ErrCodeInvalidObjectState, "object is archived", nil)
+	}
+	return obj, nil
+}
+
+func (f *fakeS3) CopyObjectWithContext(_ aws.Context, in *s3.CopyObjectInput, _ ...request.Option) (*s3.CopyObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	src, err := f.source(*in.CopySource)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(src.body)) > maxCopyObjectSize {
+		return nil, awserr.New("InvalidRequest", "the specified copy source is larger than the maximum allowable size for a copy source", nil)
+	}
+	f.copied += len(src.body)
+	etag := f.putLocked(*in.Key, src.body, aws.StringValue(in.StorageClass))
+	f.objects[*in.Key].metadata = src.metadata
+	return &s3.CopyObjectOutput{CopyObjectResult: &s3.CopyObjectResult{ETag: aws.String(etag)}}, nil
+}
+
+func (f *fakeS3) CreateMultipartUploadWithContext(_ aws.Context, in *s3.CreateMultipartUploadInput, _ ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := fmt.Sprint(len(f.uploads) + 1)
+	f.uploads[id] = &fakeS3Upload{
+		key:          *in.Key,
+		storageClass: aws.StringValue(in.StorageClass),
+		metadata:     in.Metadata,
+		parts:        make(map[int64][]byte),
+	}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeS3) UploadPartCopyWithContext(_ aws.Context, in *s3.UploadPartCopyInput, _ ...request.Option) (*s3.UploadPartCopyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	src, err := f.source(*in.CopySource)
+	if err != nil {
+		return nil, err
+	}
+	var start, end int
+	if _, err := fmt.Sscanf(*in.CopySourceRange, "bytes=%d-%d", &start, &end); err != nil {
+		return nil, err
+	}
+	part := src.body[start : end+1]
+	f.copied += len(part)
+	f.uploads[*in.UploadId].parts[*in.PartNumber] = part
+	return &s3.UploadPartCopyOutput{CopyPartResult: &s3.CopyPartResult{ETag: aws.String(fmt.Sprintf(`"%x"`, md5.Sum(part)))}}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUploadWithContext(_ aws.Context, in *s3.CompleteMultipartUploadInput, _ ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	upload := f.uploads[*in.UploadId]
+	var body []byte
+	for _, p := range in.MultipartUpload.Parts {
+		body = append(body, upload.parts[*p.PartNumber]...)
+	}
+	delete(f.uploads, *in.UploadId)
+	etag := f.putLocked(upload.key, body, upload.storageClass)
+	f.objects[upload.key].metadata = upload.metadata
+	return &s3.CompleteMultipartUploadOutput{ETag: aws.String(etag)}, nil
+}
+
+func (f *fakeS3) AbortMultipartUploadWithContext(_ aws.Context, in *s3.AbortMultipartUploadInput, _ ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.uploads, *in.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
@@ -0,0 +1,204 @@
+package s3zip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxMetadataStoreSaveAttempts is the number of attempts to save the metadata store
+// while other hosts keep updating it.
+const maxMetadataStoreSaveAttempts = 5
+
+// ErrMetadataStoreConflict is returned when the changes of the metadata store
+// conflict with the changes made by another host.
+var ErrMetadataStoreConflict = errors.New("metadata store conflict")
+
+// ErrMetadataStoreCorrupted is returned when the metadata store cannot be decoded.
+var ErrMetadataStoreCorrupted = errors.New("metadata store corrupted")
+
+// LoadMetadataStore loads the metadata store from S3.
+// An empty store is returned if it does not exist yet.
+func LoadMetadataStore(ctx context.Context, s3Service s3iface.S3API, bucket, key string) (*MetadataStore, error) {
+	return newMetadataStorage(s3Service, bucket, key).load(ctx)
+}
+
+// metadataStorage loads and saves a MetadataStore object in S3.
+// The store is saved with conditional writes, so concurrent writers never overwrite each other.
+type metadataStorage struct {
+	s3Service s3iface.S3API
+	s3Bucket  string
+	key       string
+
+	// etag is the ETag of the loaded object, empty if it did not exist.
+	etag string
+	// base is a copy of the loaded store to find the changes to merge on conflict.
+	base *MetadataStore
+}
+
+func newMetadataStorage(s3Service s3iface.S3API, bucket, key string) *metadataStorage {
+	if key == "" {
+		key = DefaultMetadataStoreKey
+	}
+	return &metadataStorage{
+		s3Service: s3Service,
+		s3Bucket:  bucket,
+		key:       key,
+	}
+}
+
+func (m *metadataStorage) load(ctx context.Context) (*MetadataStore, error) {
+	slog.DebugContext(ctx, "Loading metadata store", "key", m.key)
+
+	out, err := m.s3Service.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: &m.s3Bucket,
+		Key:    aws.String(m.key),
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+			slog.InfoContext(ctx, "Metadata store not found, creating a new one")
+			s := &MetadataStore{
+				Metadata: make(map[string]*Metadata),
+			}
+			m.etag, m.base = "", proto.Clone(s).(*MetadataStore)
+			return s, nil
+		}
+
+		return nil, fmt.Errorf("get metadata from s3: %w", err)
+	}
+	defer out.Body.Close()
+
+	b, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+
+	// The ETag is kept even if the object is corrupted, so that it can be overwritten.
+	m.etag, m.base = aws.StringValue(out.ETag), &MetadataStore{Metadata: make(map[string]*Metadata)}
+
+	var s MetadataStore
+	if err := proto.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("%w: unmarshal: %w", ErrMetadataStoreCorrupted, err)
+	}
+	if s.Metadata == nil {
+		s.Metadata = make(map[string]*Metadata)
+	}
+	m.base = proto.Clone(&s).(*MetadataStore)
+
+	slog.InfoContext(ctx, "Loaded metadata store", "len", len(s.Metadata))
+	return &s, nil
+}
+
+// save writes s only if the object has not been changed since it was loaded.
+// Otherwise it reloads the object, merges the changes made to s since the load, and retries.
+// s is updated to the merged store.
+func (m *metadataStorage) save(ctx context.Context, s *MetadataStore) error {
+	_, err := m.saveMerging(ctx, s)
+	return err
+}
+
+// saveMerging is save, which also reports whether the changes of another host have been merged into s.
+func (m *metadataStorage) saveMerging(ctx context.Context, s *MetadataStore) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		err := m.put(ctx, s)
+		if err == nil {
+			m.base = proto.Clone(s).(*MetadataStore)
+			return attempt > 1, nil
+		}
+		if !isPreconditionFailed(err) {
+			return false, fmt.Errorf("put object: %w", err)
+		}
+		if attempt == maxMetadataStoreSaveAttempts {
+			return false, fmt.Errorf("metadata store is updated concurrently, gave up after %d attempts: %w", attempt, err)
+		}
+
+		slog.InfoContext(ctx, "Metadata store was updated by another host, merging", "attempt", attempt)
+		if err := m.merge(ctx, s); err != nil {
+			return false, err
+		}
+	}
+}
+
+func (m *metadataStorage) put(ctx context.Context, s *MetadataStore) error {
+	b, err := proto.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	precondition := map[string]string{"If-None-Match": "*"}
+	if m.etag != "" {
+		precondition = map[string]string{"If-Match": m.etag}
+	}
+
+	out, err := m.s3Service.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:       &m.s3Bucket,
+		Key:          aws.String(m.key),
+		Body:         bytes.NewReader(b),
+		ContentType:  aws.String("application/protobuf"),
+		StorageClass: aws.String(s3.StorageClassStandard),
+	}, request.WithSetRequestHeaders(precondition))
+	if err != nil {
+		return err
+	}
+	m.etag = aws.StringValue(out.ETag)
+	return nil
+}
+
+// merge reloads the store and applies the changes made to s since the last load or save.
+// It fails if another host has changed an entry which s has also changed.
+func (m *metadataStorage) merge(ctx context.Context, s *MetadataStore) error {
+	base := m.base
+	remote, err := m.load(ctx)
+	if err != nil {
+		return fmt.Errorf("reload metadata store: %w", err)
+	}
+	return mergeChanges(base, remote, s)
+}
+
+// mergeChanges applies the changes made to s since base to remote, and updates s to the merged store.
+// It fails if remote has changed an entry since base which s has also changed.
+func mergeChanges(base, remote, s *MetadataStore) error {
+	for key, v := range s.Metadata {
+		if proto.Equal(v, base.Metadata[key]) {
+			continue // not changed by us
+		}
+		if r, ok := remote.Metadata[key]; ok && !proto.Equal(r, base.Metadata[key]) && !proto.Equal(r, v) {
+			return fmt.Errorf("%w: %q is changed by another host", ErrMetadataStoreConflict, key)
+		}
+		remote.Metadata[key] = v
+	}
+	for key, v := range base.Metadata {
+		if _, ok := s.Metadata[key]; ok {
+			continue // not deleted by us
+		}
+		if r, ok := remote.Metadata[key]; ok && !proto.Equal(r, v) {
+			return fmt.Errorf("%w: %q is deleted but changed by another host", ErrMetadataStoreConflict, key)
+		}
+		delete(remote.Metadata, key)
+	}
+
+	s.Metadata = remote.Metadata
+	return nil
+}
+
+// isPreconditionFailed reports whether a conditional write failed because the object has been changed.
+func isPreconditionFailed(err error) bool {
+	var rerr awserr.RequestFailure
+	if !errors.As(err, &rerr) {
+		return false
+	}
+	return rerr.StatusCode() == http.StatusPreconditionFailed || rerr.Code() == "ConditionalRequestConflict"
+}
@@ -0,0 +1,95 @@
+package s3zip
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataStorage(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T, initial map[string]*Metadata) (*fakeS3, *metadataStorage, *MetadataStore, *metadataStorage, *MetadataStore) {
+		t.Helper()
+
+		s3svc := newFakeS3()
+		if initial != nil {
+			require.NoError(t, newMetadataStorage(s3svc, "bucket", "").put(ctx, &MetadataStore{Metadata: initial}))
+		}
+
+		m1 := newMetadataStorage(s3svc, "bucket", "")
+		s1, err := m1.load(ctx)
+		require.NoError(t, err)
+		m2 := newMetadataStorage(s3svc, "bucket", "")
+		s2, err := m2.load(ctx)
+		require.NoError(t, err)
+		return s3svc, m1, s1, m2, s2
+	}
+
+	load := func(t *testing.T, s3svc *fakeS3) map[string]string {
+		t.Helper()
+
+		s, err := LoadMetadataStore(ctx, s3svc, "bucket", "")
+		require.NoError(t, err)
+		got := make(map[string]string)
+		for k, v := range s.Metadata {
+			got[k] = v.Hash
+		}
+		return got
+	}
+
+	t.Run("merge concurrent writers", func(t *testing.T) {
+		s3svc, m1, s1, m2, s2 := setup(t, nil)
+
+		s1.Metadata["a"] = &Metadata{Hash: "a"}
+		require.NoError(t, m1.save(ctx, s1))
+
+		s2.Metadata["b"] = &Metadata{Hash: "b"}
+		require.NoError(t, m2.save(ctx, s2))
+		assert.Equal(t, map[string]string{"a": "a", "b": "b"}, load(t, s3svc))
+
+		// both keep saving after the merge
+		s1.Metadata["c"] = &Metadata{Hash: "c"}
+		require.NoError(t, m1.save(ctx, s1))
+		assert.Equal(t, map[string]string{"a": "a", "b": "b", "c": "c"}, load(t, s3svc))
+	})
+
+	t.Run("merge deletion", func(t *testing.T) {
+		s3svc, m1, s1, m2, s2 := setup(t, map[string]*Metadata{
+			"a": {Hash: "a"},
+			"b": {Hash: "b"},
+		})
+
+		s1.Metadata["c"] = &Metadata{Hash: "c"}
+		require.NoError(t, m1.save(ctx, s1))
+
+		delete(s2.Metadata, "a")
+		require.NoError(t, m2.save(ctx, s2))
+		assert.Equal(t, map[string]string{"b": "b", "c": "c"}, load(t, s3svc))
+	})
+
+	t.Run("same change", func(t *testing.T) {
+		s3svc, m1, s1, m2, s2 := setup(t, nil)
+
+		s1.Metadata["a"] = &Metadata{Hash: "a"}
+		require.NoError(t, m1.save(ctx, s1))
+		s2.Metadata["a"] = &Metadata{Hash: "a"}
+		require.NoError(t, m2.save(ctx, s2))
+		assert.Equal(t, map[string]string{"a": "a"}, load(t, s3svc))
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		s3svc, m1, s1, m2, s2 := setup(t, map[string]*Metadata{
+			"a": {Hash: "a"},
+		})
+
+		s1.Metadata["a"] = &Metadata{Hash: "a1"}
+		require.NoError(t, m1.save(ctx, s1))
+
+		s2.Metadata["a"] = &Metadata{Hash: "a2"}
+		require.ErrorIs(t, m2.save(ctx, s2), ErrMetadataStoreConflict)
+		assert.Equal(t, map[string]string{"a": "a1"}, load(t, s3svc))
+	})
+}
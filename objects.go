@@ -1,22 +1,32 @@
 package s3zip
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
 
 // LocalObjects returns a list of relative paths to all files and directories.
-// maxDepth is the maximum depth of recursion, 0 means no recursion.
-func LocalObjects(path string, maxDepth int) ([]string, error) {
+// maxDepth is the maximum depth of recursion, 0 means no recursion. rules override it in their subtrees, see DepthRule.
+// Links are objects by themselves unless they are skipped by the symlink policy, or are dangling when followed.
+// The files and directories with no entries selected by the filter and the ignore files are not objects.
+// Neither are the ignore files, which are archived with their directories.
+func LocalObjects(path string, maxDepth int, rules []DepthRule, symlinks SymlinkPolicy, filter Filter) ([]string, error) {
+	depths, err := newDepthRules(maxDepth, rules)
+	if err != nil {
+		return nil, err
+	}
 	if maxDepth == 0 {
 		return []string{"."}, nil
 	}
 
 	path = filepath.Clean(path)
+	ignores := newIgnoreMatcher(path)
 	var objects []string
-	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+	err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -26,20 +36,194 @@ func LocalObjects(path string, maxDepth int) ([]string, error) {
 			return fmt.Errorf("get relative path: %w", err)
 		}
 
+		slashRel := filepath.ToSlash(rel)
 		depth := strings.Count(rel, string(os.PathSeparator)) + 1
+		maxDepth := depths.depth(slashRel)
 		if depth > maxDepth {
 			return filepath.SkipDir // no more recursion
 		}
+		if filter.excluded(slashRel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		if depth < maxDepth && info.IsDir() {
+			ignored, err := ignores.ignored(slashRel, true)
+			if err != nil {
+				return err
+			}
+			if ignored {
+				return filepath.SkipDir
+			}
 			return nil // continue recursion
 		}
-		if rel != "." {
-			objects = append(objects, filepath.ToSlash(rel))
+		if rel == "." || !isObject(file, info, symlinks.orDefault()) || isIgnoreFile(slashRel, info.IsDir()) {
+			return nil
+		}
+		// The object is walked as it is by Hash, to skip it if all of its entries are filtered out or ignored.
+		ok, err := selected(file, symlinks, filter.under(slashRel))
+		if err != nil || !ok {
+			return err
+		}
+		objects = append(objects, slashRel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// DepthRule overrides the maximum depth of recursion in the subtree at Path, which is slash-separated and relative to the target.
+// MaxZipDepth is counted from the target as well, e.g. a rule of "Photos" with 2 makes each of its subdirectories an object.
+// The most specific rule of a path applies. A rule must not be above its own path, nor inside an object of the enclosing rule
+// or the default maximum depth, and there may be only one rule per path.
+type DepthRule struct {
+	Path        string `yaml:"path"`
+	MaxZipDepth int    `yaml:"max_zip_depth"`
+}
+
+// depthRules are the maximum depths of the subtrees by their paths, and the default one.
+type depthRules struct {
+	rules    map[string]int
+	maxDepth int
+}
+
+func newDepthRules(maxDepth int, rules []DepthRule) (depthRules, error) {
+	d := depthRules{rules: make(map[string]int, len(rules)), maxDepth: maxDepth}
+	for _, r := range rules {
+		p := path.Clean(filepath.ToSlash(r.Path))
+		if p == "." || path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+			return depthRules{}, fmt.Errorf("depth rule %q: path must be a subdirectory of the target", r.Path)
+		}
+		if _, ok := d.rules[p]; ok {
+			return depthRules{}, fmt.Errorf("depth rule %q: overlaps another rule of the same path", r.Path)
+		}
+		if segments := strings.Count(p, "/") + 1; r.MaxZipDepth < segments {
+			return depthRules{}, fmt.Errorf("depth rule %q: max zip depth %d is above the path", r.Path, r.MaxZipDepth)
+		}
+		d.rules[p] = r.MaxZipDepth
+	}
+	// The subtree of a rule is only walked if it is not inside an object of the enclosing rule.
+	for p := range d.rules {
+		if enclosing := d.depth(path.Dir(p)); enclosing < strings.Count(p, "/")+1 {
+			return depthRules{}, fmt.Errorf("depth rule %q: contradicts max zip depth %d of the enclosing subtree", p, enclosing)
+		}
+	}
+	return d, nil
+}
+
+// depth returns the maximum depth of the slash-separated path relative to the target, by the most specific rule.
+func (d depthRules) depth(p string) int {
+	for ; p != "."; p = path.Dir(p) {
+		if depth, ok := d.rules[p]; ok {
+			return depth
+		}
+	}
+	return d.maxDepth
+}
+
+// AutoDepth selects the objects by the sizes of the directories instead of a fixed depth.
+// A directory is an object if its files are at most MaxSize bytes, otherwise its entries are objects
+// and its subdirectories are selected likewise. A directory which has been descended into stays so
+// until its files are smaller than MinSize bytes, so that the objects do not change while sizes fluctuate in between.
+type AutoDepth struct {
+	MinSize int64
+	MaxSize int64
+}
+
+func (d AutoDepth) validate() error {
+	if d.MaxSize <= 0 {
+		return errors.New("max size must be positive")
+	}
+	if d.MinSize > d.MaxSize {
+		return fmt.Errorf("min size %d is larger than max size %d", d.MinSize, d.MaxSize)
+	}
+	return nil
+}
+
+// AutoLocalObjects returns a list of relative paths to the objects selected by the auto depth mode.
+// As in LocalObjects, the ignore files are not objects.
+// descended reports whether a directory, by its slash-separated path relative to root, was descended into by the previous run.
+func AutoLocalObjects(root string, depth AutoDepth, symlinks SymlinkPolicy, filter Filter, descended func(dir string) bool) ([]string, error) {
+	sizes := make(map[string]int64)
+	children := make(map[string][]walkEntry)
+	_, err := walkObject(root, symlinks, filter, true, func(e walkEntry) error {
+		if e.rel == "." {
+			return nil
+		}
+		parent := path.Dir(e.rel)
+		children[parent] = append(children[parent], e)
+		if e.kind == walkFile {
+			for dir := parent; ; dir = path.Dir(dir) {
+				sizes[dir] += e.info.Size()
+				if dir == "." {
+					break
+				}
+			}
 		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
+
+	var objects []string
+	var visit func(dir string)
+	visit = func(dir string) {
+		descend := sizes[dir] > depth.MaxSize
+		if descended != nil && descended(dir) {
+			descend = sizes[dir] >= depth.MinSize
+		}
+		if !descend || len(children[dir]) == 0 {
+			objects = append(objects, dir)
+			return
+		}
+		for _, e := range children[dir] {
+			switch {
+			case e.kind == walkDir:
+				visit(e.rel)
+			case !isIgnoreFile(e.rel, false):
+				objects = append(objects, e.rel)
+			}
+		}
+	}
+	visit(".")
 	return objects, nil
 }
+
+// selected reports whether any entry of the object at name is selected by the filter and the ignore files.
+func selected(name string, symlinks SymlinkPolicy, filter Filter) (bool, error) {
+	errSelected := errors.New("selected")
+	_, err := walkObject(name, symlinks, filter, false, func(walkEntry) error {
+		return errSelected
+	})
+	if errors.Is(err, errSelected) {
+		return true, nil
+	}
+	return false, err
+}
+
+// isIgnoreFile reports whether the entry at the slash-separated path rel is an ignore file.
+func isIgnoreFile(rel string, dir bool) bool {
+	return !dir && path.Base(rel) == IgnoreFileName
+}
+
+// isObject reports whether the file is archived by the symlink policy.
+func isObject(file string, info os.FileInfo, symlinks SymlinkPolicy) bool {
+	if info.Mode()&os.ModeSymlink != 0 {
+		switch symlinks {
+		case SymlinksSkip:
+			return false
+		case SymlinksPreserve:
+			return true
+		}
+		target, err := os.Stat(file)
+		if err != nil {
+			return false
+		}
+		info = target
+	}
+	return info.IsDir() || info.Mode().IsRegular()
+}
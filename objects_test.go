@@ -2,9 +2,12 @@ package s3zip
 
 import (
 	"fmt"
+	"slices"
 	"sort"
+	"strings"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -40,7 +43,7 @@ func TestLocalObjects(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(fmt.Sprintf("depth=%d", tt.depth), func(t *testing.T) {
-			got, err := LocalObjects(dir, tt.depth)
+			got, err := LocalObjects(dir, tt.depth, nil, SymlinksFollow, Filter{})
 			require.NoError(t, err)
 
 			sort.Strings(got)
@@ -49,3 +52,97 @@ func TestLocalObjects(t *testing.T) {
 		})
 	}
 }
+
+func TestLocalObjectsDepthRules(t *testing.T) {
+	dir := setupTestDir(t, "", []testFile{
+		{path: "Photos/2023/a.jpg", content: "a"},
+		{path: "Photos/2024/b.jpg", content: "b"},
+		{path: "Photos/2024/raw/c.raw", content: "c"},
+		{path: "Photos/d.jpg", content: "d"},
+		{path: "Documents/e/f.txt", content: "f"},
+		{path: "Music/g/h.mp3", content: "h"},
+	})
+
+	got, err := LocalObjects(dir, 2, []DepthRule{
+		{Path: "Photos", MaxZipDepth: 3},
+		{Path: "Photos/2024", MaxZipDepth: 2},
+		{Path: "Documents/", MaxZipDepth: 1},
+	}, SymlinksFollow, Filter{})
+	require.NoError(t, err)
+	sort.Strings(got)
+	require.Equal(t, []string{
+		"Documents",
+		"Music/g",
+		"Photos/2023/a.jpg",
+		"Photos/2024",
+		"Photos/d.jpg",
+	}, got, "the most specific rule should apply")
+
+	for _, rules := range [][]DepthRule{
+		{{Path: "Photos", MaxZipDepth: 2}, {Path: "Photos/", MaxZipDepth: 3}},
+		{{Path: "Photos/2024", MaxZipDepth: 1}},
+		{{Path: "Photos", MaxZipDepth: 1}, {Path: "Photos/2024/raw", MaxZipDepth: 4}},
+		{{Path: "Photos/2024/raw", MaxZipDepth: 3}},
+		{{Path: "../Photos", MaxZipDepth: 3}},
+	} {
+		_, err := LocalObjects(dir, 2, rules, SymlinksFollow, Filter{})
+		assert.Error(t, err, "rules %v should be rejected", rules)
+	}
+}
+
+func TestAutoLocalObjects(t *testing.T) {
+	dir := setupTestDir(t, "", []testFile{
+		{path: "big/a", content: strings.Repeat("a", 30)},
+		{path: "big/b", content: strings.Repeat("b", 30)},
+		{path: "big/" + IgnoreFileName, content: ""},
+		{path: "small/c", content: strings.Repeat("c", 5)},
+		{path: "d.txt", content: "d"},
+	})
+
+	tests := []struct {
+		name      string
+		depth     AutoDepth
+		descended []string
+		want      []string
+	}{
+		{
+			name:  "first run",
+			depth: AutoDepth{MinSize: 20, MaxSize: 50},
+			want:  []string{"big/a", "big/b", "d.txt", "small"},
+		},
+		{
+			name:  "root within the maximum",
+			depth: AutoDepth{MinSize: 20, MaxSize: 100},
+			want:  []string{"."},
+		},
+		{
+			name:      "descended directories within the range",
+			depth:     AutoDepth{MinSize: 50, MaxSize: 100},
+			descended: []string{".", "big"},
+			want:      []string{"big/a", "big/b", "d.txt", "small"},
+		},
+		{
+			name:      "descended directory below the minimum",
+			depth:     AutoDepth{MinSize: 50, MaxSize: 100},
+			descended: []string{".", "big", "small"},
+			want:      []string{"big/a", "big/b", "d.txt", "small"},
+		},
+		{
+			name:      "descended root below the minimum",
+			depth:     AutoDepth{MinSize: 80, MaxSize: 100},
+			descended: []string{".", "big"},
+			want:      []string{"."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AutoLocalObjects(dir, tt.depth, SymlinksFollow, Filter{}, func(d string) bool {
+				return slices.Contains(tt.descended, d)
+			})
+			require.NoError(t, err)
+
+			sort.Strings(got)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package s3zip
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// localObject is a local object with its hash and size.
+type localObject struct {
+	name string
+	hash string
+	size int
+}
+
+// planPacks packs the small objects together by their directories, and returns the S3 keys of the packs
+// and the packs to upload as they are changed. A pack is kept as long as all of its members are unchanged,
+// otherwise its members are packed again with the new small objects of the directory.
+// An object which is the only one to pack in its directory is returned in singles, to be archived on its own.
+// The packs of the keys in kept are kept as they are, and so are their members.
+func (c *runClient) planPacks(ctx context.Context, small []localObject, kept map[string]bool) ([]string, []ObjectToUpload, []localObject, error) {
+	packs := c.listNumbered(func(k archiveKey) int { return k.pack })
+	byDir := make(map[string][]localObject)
+	for _, o := range small {
+		dir := path.Dir(o.name)
+		byDir[dir] = append(byDir[dir], o)
+	}
+
+	var (
+		keys    []string
+		uploads []ObjectToUpload
+		singles []localObject
+	)
+	for dir, objects := range byDir {
+		unpacked := make(map[string]localObject, len(objects))
+		for _, o := range objects {
+			unpacked[path.Base(o.name)] = o
+		}
+
+		numbers := make([]int, 0, len(packs[dir]))
+		for number := range packs[dir] {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		used := make(map[int]bool)
+		for _, number := range numbers {
+			key := makeS3PackKey(c.path, c.outPrefix, dir, number, c.format)
+			unchanged := kept[key]
+			if !unchanged {
+				var err error
+				unchanged, err = c.packUnchanged(ctx, key, dir, packs[dir][number], unpacked)
+				if err != nil {
+					return nil, nil, nil, fmt.Errorf("compare hash %q: %w", key, err)
+				}
+			}
+			if !unchanged {
+				continue
+			}
+			used[number] = true
+			keys = append(keys, key)
+			for _, member := range packs[dir][number].Pack.Members {
+				delete(unpacked, member.Name)
+			}
+		}
+
+		rest := make([]localObject, 0, len(unpacked))
+		for _, o := range unpacked {
+			rest = append(rest, o)
+		}
+		sort.Slice(rest, func(i, j int) bool {
+			return rest[i].name < rest[j].name
+		})
+		groups := groupSmallObjects(rest, c.minArchiveSize)
+		if len(groups) == 1 && len(groups[0]) == 1 {
+			singles = append(singles, groups[0][0])
+			continue
+		}
+
+		number := 1
+		for _, g := range groups {
+			for used[number] {
+				number++
+			}
+			used[number] = true
+			key := makeS3PackKey(c.path, c.outPrefix, dir, number, c.format)
+			v, err := c.packToUpload(dir, key, g)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("pack %q: %w", key, err)
+			}
+			keys = append(keys, key)
+			uploads = append(uploads, v)
+		}
+	}
+	return keys, uploads, singles, nil
+}
+
+// packUnchanged reports whether all members of the pack with the metadata m are unchanged objects in unpacked, by their base names.
+// If m was hashed with another mode, its members are hashed again with that mode,
+// and if they are unchanged the metadata is migrated to the current mode without uploading again.
+func (c *runClient) packUnchanged(ctx context.Context, key, dir string, m *Metadata, unpacked map[string]localObject) (bool, error) {
+	if m.Pack == nil || len(m.Pack.Members) == 0 {
+		return false, nil
+	}
+	members := make([]*PackMember, len(m.Pack.Members))
+	for i, member := range m.Pack.Members {
+		o, ok := unpacked[member.Name]
+		if !ok {
+			return false, nil
+		}
+		members[i] = &PackMember{Name: member.Name, Hash: o.hash, Size: int64(o.size)}
+	}
+
+	unchanged, err := c.unchanged(ctx, key, m, packHash(members), func(mode HashMode) (string, error) {
+		old := make([]*PackMember, len(members))
+		for i, member := range members {
+			h, err := Hash(filepath.Join(c.path, dir, member.Name), mode, c.symlinks, c.filter.under(path.Join(dir, member.Name)))
+			if err != nil {
+				return "", err
+			}
+			old[i] = &PackMember{Name: member.Name, Hash: h}
+		}
+		return packHash(old), nil
+	})
+	if err != nil || !unchanged {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m.Pack = &PackContents{Members: members}
+	return true, nil
+}
+
+// packToUpload returns the pack of the objects in the directory dir to upload at the key.
+func (c *runClient) packToUpload(dir, key string, objects []localObject) (ObjectToUpload, error) {
+	contents := &PackContents{}
+	var (
+		entries []walkEntry
+		size    int
+	)
+	for _, o := range objects {
+		name := path.Base(o.name)
+		contents.Members = append(contents.Members, &PackMember{Name: name, Hash: o.hash, Size: int64(o.size)})
+		memberEntries, err := packMemberEntries(filepath.Join(c.path, o.name), name, c.symlinks, c.filter.under(o.name))
+		if err != nil {
+			return ObjectToUpload{}, fmt.Errorf("list files %q: %w", o.name, err)
+		}
+		entries = append(entries, memberEntries...)
+		size += o.size
+	}
+	return ObjectToUpload{
+		Name:    dir,
+		Key:     key,
+		Hash:    packHash(contents.Members),
+		Size:    size,
+		Pack:    contents,
+		entries: entries,
+	}, nil
+}
+
+// packMemberEntries returns the entries of the object at localPath under its base name in a pack.
+// An empty directory is an entry by itself, otherwise it would not be restored.
+func packMemberEntries(localPath, name string, symlinks SymlinkPolicy, filter Filter) ([]walkEntry, error) {
+	entries, _, err := objectEntries(localPath, symlinks, filter)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		if e.rel == "." {
+			entries[i].rel = name
+		} else {
+			entries[i].rel = name + "/" + e.rel
+		}
+	}
+	if len(entries) == 0 {
+		info, err := os.Stat(localPath)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, walkEntry{kind: walkDir, rel: name, path: localPath, info: info, empty: true})
+	}
+	return entries, nil
+}
+
+// packHash returns the hash of a pack of the members, which only depends on their names and hashes.
+func packHash(members []*PackMember) string {
+	lines := make([]string, len(members))
+	for i, m := range members {
+		lines[i] = fmt.Sprintf("pack %s  %s\n", m.Hash, m.Name)
+	}
+	sort.Strings(lines)
+	return sumHashLines(lines)
+}
+
+// groupSmallObjects groups the sorted objects in order, closing a group once its size reaches minSize.
+// The last group is merged into the previous one if it is smaller.
+func groupSmallObjects(objects []localObject, minSize int64) [][]localObject {
+	var (
+		groups [][]localObject
+		start  int
+		size   int64
+	)
+	for i, o := range objects {
+		size += int64(o.size)
+		if size >= minSize {
+			groups = append(groups, objects[start:i+1])
+			start, size = i+1, 0
+		}
+	}
+	if start < len(objects) {
+		if len(groups) > 0 {
+			groups[len(groups)-1] = objects[start-len(groups[len(groups)-1]):]
+		} else {
+			groups = append(groups, objects[start:])
+		}
+	}
+	return groups
+}
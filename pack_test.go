@@ -0,0 +1,31 @@
+package s3zip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupSmallObjects(t *testing.T) {
+	objects := func(sizes ...int) []localObject {
+		res := make([]localObject, len(sizes))
+		for i, size := range sizes {
+			res[i] = localObject{name: string(rune('a' + i)), size: size}
+		}
+		return res
+	}
+	sizes := func(groups [][]localObject) [][]int {
+		res := make([][]int, len(groups))
+		for i, g := range groups {
+			for _, o := range g {
+				res[i] = append(res[i], o.size)
+			}
+		}
+		return res
+	}
+
+	assert.Equal(t, [][]int{{5, 5}, {9, 1}}, sizes(groupSmallObjects(objects(5, 5, 9, 1), 10)))
+	assert.Equal(t, [][]int{{5, 5}, {9, 1, 3}}, sizes(groupSmallObjects(objects(5, 5, 9, 1, 3), 10)), "the last small group should be merged")
+	assert.Equal(t, [][]int{{1, 2}}, sizes(groupSmallObjects(objects(1, 2), 10)))
+	assert.Empty(t, groupSmallObjects(nil, 10))
+}
@@ -0,0 +1,211 @@
+package s3zip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// User metadata of the uploaded archives, from which Reindex rebuilds the metadata store.
+const (
+	userMetadataHash       = "S3zip-Hash"
+	userMetadataHashMode   = "S3zip-Hash-Mode"
+	userMetadataSourceSize = "S3zip-Source-Size"
+	userMetadataVersion    = "S3zip-Version"
+	userMetadataObjectKind = "S3zip-Object-Kind"
+	// userMetadataPackMembers are the escaped base names of the members of a pack, separated by slashes.
+	userMetadataPackMembers = "S3zip-Pack-Members"
+)
+
+// maxPackMembersMetadata is the maximum length of the members of a pack in the user metadata,
+// which S3 limits to 2 KB with the other fields. A pack with longer members is uploaded again by the run after a reindex.
+const maxPackMembersMetadata = 1536
+
+type (
+	ReindexInput struct {
+		DryRun           bool
+		S3Bucket         string
+		S3Service        s3iface.S3API
+		MetadataStoreKey string
+		Path             string
+		OutPrefix        string
+		Concurrency      int
+	}
+
+	ReindexOutput struct {
+		// Archives is the number of archives of the target in the bucket.
+		Archives int
+		// Rebuilt is the number of archives whose metadata has been rebuilt from the bucket.
+		Rebuilt int
+		// Unknown is the number of archives without s3zip user metadata, they are re-uploaded by the next run.
+		Unknown int
+		// Removed is the number of metadata entries removed because their archives do not exist.
+		Removed int
+	}
+)
+
+// Reindex rebuilds the metadata of the archives of a target from the user metadata of the archives in the bucket.
+// Existing entries are kept as is if they still describe the archive in the bucket, i.e. their ETags match.
+// The manifests of rebuilt archives are not recovered.
+func Reindex(ctx context.Context, in *ReindexInput) (*ReindexOutput, error) {
+	concurrency := in.Concurrency
+	if concurrency == 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	archives, err := listArchives(ctx, in.S3Service, in.S3Bucket, in.Path, in.OutPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("list archives: %w", err)
+	}
+	slog.InfoContext(ctx, "Listed archives", "len", len(archives))
+
+	storage := newMetadataStorage(in.S3Service, in.S3Bucket, in.MetadataStoreKey)
+	store, err := storage.load(ctx)
+	if errors.Is(err, ErrMetadataStoreCorrupted) {
+		slog.WarnContext(ctx, "Metadata store is corrupted, rebuilding a new one", "error", err)
+		store, err = &MetadataStore{Metadata: make(map[string]*Metadata)}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load metadata store: %w", err)
+	}
+
+	out := &ReindexOutput{
+		Archives: len(archives),
+	}
+	var mu sync.Mutex
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(concurrency)
+
+	exists := make(map[string]struct{}, len(archives))
+	for _, a := range archives {
+		exists[a.Key] = struct{}{}
+		eg.Go(func() error {
+			head, err := in.S3Service.HeadObjectWithContext(egCtx, &s3.HeadObjectInput{
+				Bucket: &in.S3Bucket,
+				Key:    aws.String(a.Key),
+			})
+			if err != nil {
+				return fmt.Errorf("head %q: %w", a.Key, err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if m, ok := store.Metadata[a.Key]; ok && m.Etag != "" && m.Etag == aws.StringValue(head.ETag) {
+				return nil
+			}
+
+			m := metadataFromHead(head)
+			if m.Hash == "" {
+				slog.WarnContext(egCtx, "Archive has no s3zip metadata", "s3-key", a.Key)
+				out.Unknown++
+			}
+			slog.InfoContext(egCtx, "Rebuilt metadata", "s3-key", a.Key)
+			store.Metadata[a.Key] = m
+			out.Rebuilt++
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	for key := range store.Metadata {
+		if _, ok := parseS3Key(in.Path, in.OutPrefix, key); !ok {
+			continue
+		}
+		if _, ok := exists[key]; !ok {
+			slog.InfoContext(ctx, "Removing metadata of missing archive", "s3-key", key)
+			delete(store.Metadata, key)
+			out.Removed++
+		}
+	}
+
+	if in.DryRun {
+		return out, nil
+	}
+	if err := storage.save(ctx, store); err != nil {
+		return nil, fmt.Errorf("save metadata store: %w", err)
+	}
+	return out, nil
+}
+
+// archiveUserMetadata returns the user metadata of the archive described by m.
+func archiveUserMetadata(m *Metadata) map[string]*string {
+	user := map[string]*string{
+		userMetadataHash:       aws.String(m.Hash),
+		userMetadataHashMode:   aws.String(m.HashMode),
+		userMetadataSourceSize: aws.String(strconv.FormatInt(m.SourceSize, 10)),
+		userMetadataVersion:    aws.String(m.Version),
+		userMetadataObjectKind: aws.String(m.ObjectKind),
+	}
+	if members := m.GetPack().GetMembers(); len(members) > 0 {
+		names := make([]string, len(members))
+		for i, member := range members {
+			names[i] = url.PathEscape(member.Name)
+		}
+		if v := strings.Join(names, "/"); len(v) <= maxPackMembersMetadata {
+			user[userMetadataPackMembers] = aws.String(v)
+		}
+	}
+	return user
+}
+
+// metadataFromHead rebuilds the metadata of an archive from its HeadObject response.
+func metadataFromHead(head *s3.HeadObjectOutput) *Metadata {
+	user := make(map[string]string, len(head.Metadata))
+	for k, v := range head.Metadata {
+		user[strings.ToLower(k)] = aws.StringValue(v)
+	}
+
+	m := &Metadata{
+		Hash:         user[strings.ToLower(userMetadataHash)],
+		HashMode:     user[strings.ToLower(userMetadataHashMode)],
+		Version:      user[strings.ToLower(userMetadataVersion)],
+		ObjectKind:   user[strings.ToLower(userMetadataObjectKind)],
+		Size:         aws.Int64Value(head.ContentLength),
+		StorageClass: aws.StringValue(head.StorageClass),
+		Etag:         aws.StringValue(head.ETag),
+		VersionId:    aws.StringValue(head.VersionId),
+	}
+	if m.StorageClass == "" {
+		m.StorageClass = s3.StorageClassStandard // HeadObject omits the standard storage class
+	}
+	if head.LastModified != nil {
+		m.UploadedAt = timestamppb.New(*head.LastModified)
+	}
+	if v, err := strconv.ParseInt(user[strings.ToLower(userMetadataSourceSize)], 10, 64); err == nil {
+		m.SourceSize = v
+	}
+	if v := user[strings.ToLower(userMetadataPackMembers)]; v != "" {
+		m.Pack = packFromUserMetadata(v)
+	}
+	return m
+}
+
+// packFromUserMetadata returns the members of a pack by their names, nil if they are malformed.
+// Their hashes are not stored, the pack is unchanged as long as the hashes of the local objects make the hash of the pack.
+func packFromUserMetadata(v string) *PackContents {
+	pack := &PackContents{}
+	for _, escaped := range strings.Split(v, "/") {
+		name, err := url.PathUnescape(escaped)
+		if err != nil || name == "" {
+			return nil
+		}
+		pack.Members = append(pack.Members, &PackMember{Name: name})
+	}
+	return pack
+}
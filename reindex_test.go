@@ -0,0 +1,90 @@
+package s3zip
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReindex(t *testing.T) {
+	ctx := context.Background()
+	s3svc := newFakeS3()
+
+	putArchive := func(t *testing.T, key string, m *Metadata) {
+		t.Helper()
+
+		_, err := s3svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:       aws.String("bucket"),
+			Key:          aws.String(key),
+			Body:         bytes.NewReader([]byte(key)),
+			StorageClass: aws.String(s3.StorageClassDeepArchive),
+			Metadata:     archiveUserMetadata(m),
+		})
+		require.NoError(t, err)
+	}
+	putArchive(t, "pref/target/a.zip", &Metadata{Hash: "hash-a", SourceSize: 10, Version: "v1", ObjectKind: objectKindDir})
+	putArchive(t, "pref/target/b.zip", &Metadata{Hash: "hash-b", SourceSize: 20, Version: "v1"})
+	putArchive(t, "pref/target/.s3zip-pack-0001.zip", &Metadata{Hash: "hash-pack", Pack: &PackContents{Members: []*PackMember{
+		{Name: "a b.txt", Hash: "hash-ab", Size: 1},
+		{Name: "日本%.txt", Hash: "hash-jp", Size: 2},
+	}}})
+	s3svc.put("pref/target/legacy.zip", []byte("legacy"), s3.StorageClassDeepArchive)
+	s3svc.put(DefaultMetadataStoreKey, []byte("corrupted"), s3.StorageClassStandard)
+
+	in := &ReindexInput{
+		S3Bucket:  "bucket",
+		S3Service: s3svc,
+		Path:      "/path/to/target",
+		OutPrefix: "pref",
+	}
+
+	t.Run("rebuild", func(t *testing.T) {
+		out, err := Reindex(ctx, in)
+		require.NoError(t, err)
+		assert.Equal(t, &ReindexOutput{Archives: 4, Rebuilt: 4, Unknown: 1}, out)
+
+		store, err := LoadMetadataStore(ctx, s3svc, "bucket", "")
+		require.NoError(t, err)
+		require.Len(t, store.Metadata, 4)
+		a := store.Metadata["pref/target/a.zip"]
+		assert.Equal(t, "hash-a", a.Hash)
+		assert.EqualValues(t, 10, a.SourceSize)
+		assert.Equal(t, "v1", a.Version)
+		assert.Equal(t, objectKindDir, a.ObjectKind)
+		assert.Equal(t, s3.StorageClassDeepArchive, a.StorageClass)
+		assert.EqualValues(t, len("pref/target/a.zip"), a.Size)
+		assert.Empty(t, store.Metadata["pref/target/legacy.zip"].Hash)
+		assert.Nil(t, a.Pack)
+
+		var members []string
+		for _, member := range store.Metadata["pref/target/.s3zip-pack-0001.zip"].GetPack().GetMembers() {
+			members = append(members, member.Name)
+		}
+		assert.Equal(t, []string{"a b.txt", "日本%.txt"}, members)
+	})
+
+	t.Run("keep up-to-date entries and remove missing archives", func(t *testing.T) {
+		storage := newMetadataStorage(s3svc, "bucket", "")
+		store, err := storage.load(ctx)
+		require.NoError(t, err)
+		store.Metadata["pref/target/a.zip"].Entries = []*Entry{{Name: "a.txt"}}
+		store.Metadata["pref/target/deleted.zip"] = &Metadata{Hash: "hash-deleted"}
+		store.Metadata["pref/other/x.zip"] = &Metadata{Hash: "hash-x"}
+		require.NoError(t, storage.save(ctx, store))
+
+		out, err := Reindex(ctx, in)
+		require.NoError(t, err)
+		assert.Equal(t, &ReindexOutput{Archives: 4, Removed: 1}, out)
+
+		store, err = LoadMetadataStore(ctx, s3svc, "bucket", "")
+		require.NoError(t, err)
+		assert.NotContains(t, store.Metadata, "pref/target/deleted.zip")
+		assert.Contains(t, store.Metadata, "pref/other/x.zip")
+		assert.Len(t, store.Metadata["pref/target/a.zip"].Entries, 1)
+	})
+}
@@ -0,0 +1,552 @@
+package s3zip
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"golang.org/x/sync/errgroup"
+)
+
+type (
+	RestoreInput struct {
+		DryRun      bool
+		S3Bucket    string
+		S3Service   s3iface.S3API
+		Path        string
+		OutPrefix   string
+		Dest        string
+		Concurrency int
+	}
+
+	RestoreOutput struct {
+		Download int
+		Extract  int
+	}
+
+	// Archive is an uploaded archive of a local object.
+	Archive struct {
+		Key    string
+		Object string
+		// PartNumber is the number of the part if the object is split into parts, otherwise 0.
+		PartNumber int
+		// PackNumber is the number of the pack if the archive is a pack of the small objects in the directory Object, otherwise 0.
+		PackNumber   int
+		Format       Format
+		Size         int64
+		StorageClass string
+	}
+
+	restoreClient struct {
+		dryRun bool
+
+		s3Bucket string
+
+		s3Service    s3iface.S3API
+		s3Downloader *s3manager.Downloader
+
+		path      string
+		outPrefix string
+		dest      string
+
+		concurrency int
+	}
+)
+
+func newRestoreClient(in *RestoreInput) *restoreClient {
+	c := restoreClient{
+		dryRun: in.DryRun,
+
+		s3Bucket: in.S3Bucket,
+
+		s3Service: in.S3Service,
+		s3Downloader: s3manager.NewDownloaderWithClient(in.S3Service, func(d *s3manager.Downloader) {
+			d.PartSize = 64 * 1024 * 1024
+		}),
+
+		path:      in.Path,
+		outPrefix: in.OutPrefix,
+		dest:      in.Dest,
+
+		concurrency: in.Concurrency,
+	}
+
+	if c.concurrency == 0 {
+		c.concurrency = DefaultConcurrency
+	}
+
+	return &c
+}
+
+// Restore downloads the archives of a target and extracts them under the destination directory,
+// reproducing the relative paths of the local objects.
+func Restore(ctx context.Context, in *RestoreInput) (*RestoreOutput, error) {
+	return newRestoreClient(in).restore(ctx)
+}
+
+func (c *restoreClient) restore(ctx context.Context) (*RestoreOutput, error) {
+	archives, err := listArchives(ctx, c.s3Service, c.s3Bucket, c.path, c.outPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("list archives: %w", err)
+	}
+	slog.InfoContext(ctx, "Listed archives", "len", len(archives))
+
+	out := &RestoreOutput{
+		Download: len(archives),
+	}
+	if c.dryRun {
+		for _, a := range archives {
+			slog.InfoContext(ctx, "Restoring", "s3-key", a.Key, "object", a.Object)
+		}
+		return out, nil
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(c.concurrency)
+
+	counts := make([]int, len(archives))
+	for i, a := range archives {
+		eg.Go(func() error {
+			n, err := c.restoreArchive(ctx, a)
+			if err != nil {
+				return fmt.Errorf("restore %q: %w", a.Key, err)
+			}
+			counts[i] = n
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	for _, n := range counts {
+		out.Extract += n
+	}
+	return out, nil
+}
+
+func (c *restoreClient) restoreArchive(ctx context.Context, a Archive) (int, error) {
+	slog.InfoContext(ctx, "Restoring", "s3-key", a.Key, "object", a.Object)
+
+	head, err := c.s3Service.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &c.s3Bucket,
+		Key:    aws.String(a.Key),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("head: %w", err)
+	}
+	kind := metadataFromHead(head).ObjectKind
+
+	f, err := os.CreateTemp("", "s3zip-*"+a.Format.Ext())
+	if err != nil {
+		return 0, fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	size, err := c.s3Downloader.DownloadWithContext(ctx, f, &s3.GetObjectInput{
+		Bucket: &c.s3Bucket,
+		Key:    aws.String(a.Key),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("download from s3: %w", err)
+	}
+
+	if a.Format != FormatZip {
+		return c.untarArchive(f, a, kind)
+	}
+
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return 0, fmt.Errorf("open zip: %w", err)
+	}
+	names := make([]string, len(zr.File))
+	for i, zf := range zr.File {
+		names[i] = zf.Name
+	}
+	return unzip(zr, c.dest, filepath.Join(c.dest, filepath.FromSlash(objectDir(a.Object, a.PartNumber != 0 || a.PackNumber != 0, kind, names))))
+}
+
+// untarArchive extracts the downloaded tar archive f of an object of the kind.
+// The archive is read twice, as the names of its files decide the directory to extract them if the kind is unknown.
+func (c *restoreClient) untarArchive(f *os.File, a Archive, kind string) (int, error) {
+	tr, closeTar, err := newTarReader(f, a.Format)
+	if err != nil {
+		return 0, err
+	}
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			closeTar()
+			return 0, fmt.Errorf("read tar: %w", err)
+		}
+		names = append(names, h.Name)
+	}
+	closeTar()
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("seek: %w", err)
+	}
+	tr, closeTar, err = newTarReader(f, a.Format)
+	if err != nil {
+		return 0, err
+	}
+	defer closeTar()
+	return untar(tr, c.dest, filepath.Join(c.dest, filepath.FromSlash(objectDir(a.Object, a.PartNumber != 0 || a.PackNumber != 0, kind, names))))
+}
+
+// objectDir returns the slash-separated directory, relative to the target, of the files in the archive of object of the kind.
+// An archive stores a file object as a single entry named after the file, so it belongs next to its siblings.
+// A partial archive is a part of a split directory or a pack of the objects in the directory, so its files always belong in it.
+// The kind is unknown in the archives of older versions, whose file objects are told apart by the names of their entries,
+// which is ambiguous for a directory holding a single file of the same name.
+func objectDir(object string, partial bool, kind string, names []string) string {
+	if object == "." || partial {
+		return object
+	}
+	switch kind {
+	case objectKindFile:
+		return path.Dir(object)
+	case objectKindDir:
+		return object
+	}
+	if len(names) == 1 && names[0] == path.Base(object) {
+		return path.Dir(object)
+	}
+	return object
+}
+
+// Unzip extracts all files, directories and links of the zip archive under dir.
+// It refuses entries which would be written outside of dir, and links pointing outside of it.
+func Unzip(zr *zip.Reader, dir string) (int, error) {
+	return unzip(zr, dir, dir)
+}
+
+// unzip is Unzip, which allows the links to point anywhere under root, which contains dir.
+func unzip(zr *zip.Reader, root, dir string) (int, error) {
+	var n int
+	x := extraction{root: root}
+	for _, zf := range zr.File {
+		name := filepath.FromSlash(zf.Name)
+		if !filepath.IsLocal(name) || strings.Contains(zf.Name, `\`) {
+			return n, fmt.Errorf("illegal file path in zip: %q", zf.Name)
+		}
+
+		dst := filepath.Join(dir, name)
+		switch {
+		case zf.FileInfo().IsDir():
+			if err := x.mkdirAll(dst); err != nil {
+				return n, fmt.Errorf("create directory: %w", err)
+			}
+			x.dirs = append(x.dirs, extractedDir{dst, zipAttributes(zf)})
+		case zf.Mode()&os.ModeSymlink != 0:
+			target, err := readZipSymlink(zf)
+			if err != nil {
+				return n, fmt.Errorf("extract %q: %w", zf.Name, err)
+			}
+			x.links = append(x.links, extractedLink{dst, target})
+			n++
+		default:
+			if err := x.unzipFile(zf, dst); err != nil {
+				return n, fmt.Errorf("extract %q: %w", zf.Name, err)
+			}
+			n++
+		}
+	}
+	return n, x.finish()
+}
+
+func (x *extraction) unzipFile(zf *zip.File, dst string) error {
+	r, err := zf.Open()
+	if err != nil {
+		return fmt.Errorf("open zip file: %w", err)
+	}
+	defer r.Close()
+	if err := x.writeFile(dst, r); err != nil {
+		return err
+	}
+	return zipAttributes(zf).apply(dst)
+}
+
+// maxSymlinkTargetSize is the maximum length of the target of a link in a zip archive.
+const maxSymlinkTargetSize = 4096
+
+func readZipSymlink(zf *zip.File) (string, error) {
+	r, err := zf.Open()
+	if err != nil {
+		return "", fmt.Errorf("open zip file: %w", err)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(io.LimitReader(r, maxSymlinkTargetSize+1))
+	if err != nil {
+		return "", fmt.Errorf("read symlink: %w", err)
+	}
+	if len(b) > maxSymlinkTargetSize {
+		return "", errors.New("symlink target is too long")
+	}
+	return string(b), nil
+}
+
+// zipAttributes returns the attributes of a file stored by Pack, or by other tools on Unix.
+func zipAttributes(zf *zip.File) fileAttributes {
+	a := fileAttributes{uid: -1, gid: -1}
+	if zf.ModifiedDate != 0 { // not stripped
+		a.modified = zf.Modified
+	}
+	if zf.CreatorVersion>>8 == zipCreatorUnix {
+		a.mode = zf.Mode().Perm()
+	}
+	if uid, gid, ok := parseZipUnixOwnerExtra(zf.Extra); ok {
+		a.uid, a.gid = uid, gid
+	}
+	return a
+}
+
+// Untar extracts all regular files, directories and links of the tar stream under dir.
+// It refuses entries which would be written outside of dir, and links pointing outside of it.
+func Untar(tr *tar.Reader, dir string) (int, error) {
+	return untar(tr, dir, dir)
+}
+
+// untar is Untar, which allows the links to point anywhere under root, which contains dir.
+func untar(tr *tar.Reader, root, dir string) (int, error) {
+	var n int
+	x := extraction{root: root}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return n, x.finish()
+		}
+		if err != nil {
+			return n, fmt.Errorf("read tar: %w", err)
+		}
+
+		name := filepath.FromSlash(h.Name)
+		if !filepath.IsLocal(name) || strings.Contains(h.Name, `\`) {
+			return n, fmt.Errorf("illegal file path in tar: %q", h.Name)
+		}
+
+		dst := filepath.Join(dir, name)
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := x.mkdirAll(dst); err != nil {
+				return n, fmt.Errorf("create directory: %w", err)
+			}
+			x.dirs = append(x.dirs, extractedDir{dst, tarAttributes(h)})
+		case tar.TypeSymlink:
+			x.links = append(x.links, extractedLink{dst, h.Linkname})
+			n++
+		case tar.TypeReg:
+			if err := x.writeFile(dst, tr); err != nil {
+				return n, fmt.Errorf("extract %q: %w", h.Name, err)
+			}
+			if err := tarAttributes(h).apply(dst); err != nil {
+				return n, fmt.Errorf("extract %q: %w", h.Name, err)
+			}
+			n++
+		}
+	}
+}
+
+func tarAttributes(h *tar.Header) fileAttributes {
+	a := fileAttributes{mode: os.FileMode(h.Mode).Perm(), uid: h.Uid, gid: h.Gid}
+	if h.ModTime.Unix() != 0 { // not stripped
+		a.modified = h.ModTime
+	}
+	return a
+}
+
+type (
+	// extraction defers the creation of links and the attributes of directories until all files are extracted,
+	// so that no file is written through an extracted link, and the directories keep their modification times.
+	// The archives are extracted concurrently into the same root, so it also refuses to write through the links of the others.
+	extraction struct {
+		root  string
+		links []extractedLink
+		dirs  []extractedDir
+	}
+
+	extractedLink struct {
+		dst, target string
+	}
+
+	extractedDir struct {
+		dst        string
+		attributes fileAttributes
+	}
+)
+
+func (x *extraction) finish() error {
+	for _, l := range x.links {
+		if err := x.checkLink(l); err != nil {
+			return err
+		}
+		if err := x.mkdirAll(filepath.Dir(l.dst)); err != nil {
+			return fmt.Errorf("create directory: %w", err)
+		}
+		if err := os.Symlink(l.target, l.dst); err != nil {
+			return fmt.Errorf("create symlink: %w", err)
+		}
+	}
+	for _, d := range x.dirs {
+		if err := d.attributes.apply(d.dst); err != nil {
+			return fmt.Errorf("set attributes of %q: %w", d.dst, err)
+		}
+	}
+	return nil
+}
+
+// zipCreatorUnix is the "version made by" of zip entries whose external attributes hold Unix mode bits.
+const zipCreatorUnix = 3
+
+// fileAttributes are the attributes of an extracted file stored in its archive.
+type fileAttributes struct {
+	// modified is zero if unknown.
+	modified time.Time
+	// mode is the permission bits, 0 if unknown.
+	mode os.FileMode
+	// uid and gid are -1 if unknown.
+	uid, gid int
+}
+
+// apply sets the attributes to the file. The ownership is only restored when running as root.
+func (a fileAttributes) apply(name string) error {
+	if a.mode != 0 {
+		if err := os.Chmod(name, a.mode); err != nil {
+			return fmt.Errorf("chmod: %w", err)
+		}
+	}
+	if a.uid >= 0 && a.gid >= 0 && os.Geteuid() == 0 {
+		if err := os.Chown(name, a.uid, a.gid); err != nil {
+			return fmt.Errorf("chown: %w", err)
+		}
+	}
+	if !a.modified.IsZero() {
+		if err := os.Chtimes(name, time.Time{}, a.modified); err != nil {
+			return fmt.Errorf("chtimes: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkLink refuses the link if its target is outside of the root.
+func (x *extraction) checkLink(l extractedLink) error {
+	root, err := filepath.Abs(x.root)
+	if err != nil {
+		return err
+	}
+	target := l.target
+	if !filepath.IsAbs(target) {
+		dst, err := filepath.Abs(l.dst)
+		if err != nil {
+			return err
+		}
+		target = filepath.Join(filepath.Dir(dst), target)
+	}
+	if !under(root, filepath.Clean(target)) {
+		return fmt.Errorf("symlink %q points outside of %q: %q", l.dst, x.root, l.target)
+	}
+	return nil
+}
+
+// mkdirAll creates the directory and its parents, refusing to create them through links under the root.
+func (x *extraction) mkdirAll(dir string) error {
+	rel, err := filepath.Rel(x.root, dir)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsLocal(rel) && rel != "." {
+		return fmt.Errorf("%q is outside of %q", dir, x.root)
+	}
+	p := x.root
+	for _, c := range strings.Split(rel, string(filepath.Separator)) {
+		if c == "." {
+			break
+		}
+		p = filepath.Join(p, c)
+		info, err := os.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%q is a symlink", p)
+		}
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// writeFile creates the file dst and its parent directories, and writes the content read from r.
+// An existing file is replaced, but the file is never opened through a link.
+func (x *extraction) writeFile(dst string, r io.Reader) error {
+	if err := x.mkdirAll(filepath.Dir(dst)); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+
+	if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove file: %w", err)
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL|oNoFollow, 0o666)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("copy file: %w", err)
+	}
+	return f.Close()
+}
+
+// listArchives returns the archives uploaded for the local path under outPrefix.
+func listArchives(ctx context.Context, s3Service s3iface.S3API, bucket, localPath, outPrefix string) ([]Archive, error) {
+	archives := make([]Archive, 0)
+	err := s3Service.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: aws.String(s3KeyRoot(localPath, outPrefix)),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			k, ok := parseArchiveKey(localPath, outPrefix, *obj.Key)
+			if !ok {
+				continue
+			}
+			format, _ := formatOf(*obj.Key)
+			archives = append(archives, Archive{
+				Key:          *obj.Key,
+				Object:       k.object,
+				PartNumber:   k.part,
+				PackNumber:   k.pack,
+				Format:       format,
+				Size:         aws.Int64Value(obj.Size),
+				StorageClass: aws.StringValue(obj.StorageClass),
+			})
+		}
+		return lastPage
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list objects: %w", err)
+	}
+	return archives, nil
+}
@@ -0,0 +1,271 @@
+package s3zip
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestore(t *testing.T) {
+	files := []testFile{
+		{path: "a1.txt", content: "a1"},
+		{path: "foo/b1.txt", content: "b1"},
+		{path: "foo/b2.txt", content: "b2"},
+		{path: "foo/bar/c1.txt", content: "c1"},
+		{path: "baz/d1.txt", content: "d1"},
+		// A directory whose only file has its name, archived like a file object at depth 1.
+		{path: "qux/qux", content: "q"},
+	}
+	dir := setupTestDir(t, "target", files)
+	s3svc, bucketName := setupTestBucket(t)
+
+	for _, format := range formats {
+		for _, depth := range []int{0, 1, 2, 3} {
+			outPrefix := fmt.Sprintf("pref/%s/%d", format, depth)
+			_, err := Run(context.Background(), &RunInput{
+				S3Bucket:         bucketName,
+				S3Service:        s3svc,
+				Path:             dir,
+				MaxZipDepth:      depth,
+				OutPrefix:        outPrefix,
+				Format:           format,
+				MetadataStoreKey: "metadata.pb",
+				S3StorageClass:   s3.StorageClassStandard,
+			})
+			require.NoError(t, err)
+
+			in := &RestoreInput{
+				S3Bucket:  bucketName,
+				S3Service: s3svc,
+				Path:      dir,
+				OutPrefix: outPrefix,
+			}
+
+			t.Run(fmt.Sprintf("%s/depth=%d/dry run", format, depth), func(t *testing.T) {
+				in := *in
+				in.DryRun = true
+				in.Dest = filepath.Join(t.TempDir(), "restored")
+
+				_, err := Restore(context.Background(), &in)
+				require.NoError(t, err)
+				assert.NoDirExists(t, in.Dest)
+			})
+
+			t.Run(fmt.Sprintf("%s/depth=%d/restore", format, depth), func(t *testing.T) {
+				in := *in
+				in.Dest = t.TempDir()
+
+				out, err := Restore(context.Background(), &in)
+				require.NoError(t, err)
+				assert.Equal(t, len(files), out.Extract)
+
+				for _, f := range files {
+					b, err := os.ReadFile(filepath.Join(in.Dest, f.path))
+					require.NoError(t, err)
+					assert.Equal(t, f.content, string(b))
+				}
+			})
+		}
+	}
+}
+
+func TestUnzip(t *testing.T) {
+	newZip := func(t *testing.T, names ...string) *zip.Reader {
+		t.Helper()
+
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for _, name := range names {
+			w, err := zw.Create(name)
+			require.NoError(t, err)
+			_, err = w.Write([]byte(name))
+			require.NoError(t, err)
+		}
+		require.NoError(t, zw.Close())
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		require.NoError(t, err)
+		return zr
+	}
+
+	t.Run("extract", func(t *testing.T) {
+		dir := t.TempDir()
+		n, err := Unzip(newZip(t, "a.txt", "foo/b.txt"), dir)
+		require.NoError(t, err)
+		assert.Equal(t, 2, n)
+		assert.FileExists(t, filepath.Join(dir, "a.txt"))
+		assert.FileExists(t, filepath.Join(dir, "foo", "b.txt"))
+	})
+
+	for _, name := range []string{"../evil.txt", "foo/../../evil.txt", "/evil.txt", `..\evil.txt`} {
+		t.Run("zip slip "+name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "dest")
+			_, err := Unzip(newZip(t, name), dir)
+			require.Error(t, err)
+			assert.NoFileExists(t, filepath.Join(filepath.Dir(dir), "evil.txt"))
+		})
+	}
+}
+
+func TestExtractAttributes(t *testing.T) {
+	src := setupTestDir(t, "", []testFile{
+		{path: "a.txt", content: "a"},
+	})
+	modified := time.Date(2015, 6, 7, 8, 9, 10, 0, time.UTC)
+	require.NoError(t, os.Chmod(filepath.Join(src, "a.txt"), 0o600))
+	require.NoError(t, os.Chtimes(filepath.Join(src, "a.txt"), time.Time{}, modified))
+
+	extract := func(t *testing.T, opts PackOptions) os.FileInfo {
+		b, err := io.ReadAll(Pack(src, opts))
+		require.NoError(t, err)
+
+		dir := t.TempDir()
+		if opts.Format.orDefault() == FormatZip {
+			zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+			require.NoError(t, err)
+			_, err = Unzip(zr, dir)
+			require.NoError(t, err)
+		} else {
+			tr, closeTar, err := newTarReader(bytes.NewReader(b), opts.Format)
+			require.NoError(t, err)
+			defer closeTar()
+			_, err = Untar(tr, dir)
+			require.NoError(t, err)
+		}
+
+		info, err := os.Stat(filepath.Join(dir, "a.txt"))
+		require.NoError(t, err)
+		return info
+	}
+
+	for _, format := range formats {
+		t.Run(string(format), func(t *testing.T) {
+			info := extract(t, PackOptions{Format: format})
+			assert.True(t, modified.Equal(info.ModTime()), info.ModTime())
+			if runtime.GOOS != "windows" {
+				assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+			}
+		})
+
+		t.Run(string(format)+"/strip", func(t *testing.T) {
+			info := extract(t, PackOptions{Format: format, StripAttributes: true})
+			assert.WithinDuration(t, time.Now(), info.ModTime(), time.Minute, "the extraction time should be kept")
+		})
+	}
+}
+
+func TestExtractSymlinks(t *testing.T) {
+	src := setupTestDir(t, "", []testFile{
+		{path: "a.txt", content: "a"},
+	})
+	require.NoError(t, os.Mkdir(filepath.Join(src, "empty"), 0o755))
+	require.NoError(t, os.Symlink("a.txt", filepath.Join(src, "link.txt")))
+
+	for _, format := range []Format{FormatZip, FormatTarGz} {
+		t.Run(string(format), func(t *testing.T) {
+			b, err := io.ReadAll(Pack(src, PackOptions{Format: format, Symlinks: SymlinksPreserve}))
+			require.NoError(t, err)
+
+			dir := t.TempDir()
+			var n int
+			if format == FormatZip {
+				zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+				require.NoError(t, err)
+				n, err = Unzip(zr, dir)
+				require.NoError(t, err)
+			} else {
+				tr, closeTar, err := newTarReader(bytes.NewReader(b), format)
+				require.NoError(t, err)
+				defer closeTar()
+				n, err = Untar(tr, dir)
+				require.NoError(t, err)
+			}
+			assert.Equal(t, 2, n)
+			assert.DirExists(t, filepath.Join(dir, "empty"))
+			target, err := os.Readlink(filepath.Join(dir, "link.txt"))
+			require.NoError(t, err)
+			assert.Equal(t, "a.txt", target)
+		})
+	}
+
+	t.Run("no write through links", func(t *testing.T) {
+		outside := t.TempDir()
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		fh := &zip.FileHeader{Name: "evil"}
+		fh.SetMode(os.ModeSymlink | 0o777)
+		w, err := zw.CreateHeader(fh)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, outside)
+		require.NoError(t, err)
+		w, err = zw.Create("evil/a.txt")
+		require.NoError(t, err)
+		_, err = io.WriteString(w, "a")
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		require.NoError(t, err)
+		_, err = Unzip(zr, t.TempDir())
+		assert.Error(t, err, "the link should conflict with the extracted directory")
+		assert.NoFileExists(t, filepath.Join(outside, "a.txt"))
+	})
+
+	for _, target := range []string{"../outside", "foo/../../outside", "/outside"} {
+		t.Run("link outside "+target, func(t *testing.T) {
+			var buf bytes.Buffer
+			zw := zip.NewWriter(&buf)
+			fh := &zip.FileHeader{Name: "link"}
+			fh.SetMode(os.ModeSymlink | 0o777)
+			w, err := zw.CreateHeader(fh)
+			require.NoError(t, err)
+			_, err = io.WriteString(w, target)
+			require.NoError(t, err)
+			require.NoError(t, zw.Close())
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			require.NoError(t, err)
+			dir := t.TempDir()
+			_, err = Unzip(zr, dir)
+			assert.Error(t, err)
+			assert.NoFileExists(t, filepath.Join(dir, "link"))
+		})
+	}
+
+	t.Run("no write through existing links", func(t *testing.T) {
+		outside, dir := t.TempDir(), t.TempDir()
+		require.NoError(t, os.Symlink(outside, filepath.Join(dir, "foo")))
+		require.NoError(t, os.Symlink(filepath.Join(outside, "a.txt"), filepath.Join(dir, "a.txt")))
+
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for _, name := range []string{"a.txt", "foo/b.txt"} {
+			w, err := zw.Create(name)
+			require.NoError(t, err)
+			_, err = io.WriteString(w, name)
+			require.NoError(t, err)
+		}
+		require.NoError(t, zw.Close())
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		require.NoError(t, err)
+		_, err = Unzip(zr, dir)
+		assert.Error(t, err, "the linked directory should be refused")
+		assert.NoFileExists(t, filepath.Join(outside, "a.txt"))
+		assert.NoFileExists(t, filepath.Join(outside, "b.txt"))
+		info, err := os.Lstat(filepath.Join(dir, "a.txt"))
+		require.NoError(t, err)
+		assert.True(t, info.Mode().IsRegular(), "the link should be replaced by the file")
+	})
+}
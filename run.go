@@ -1,12 +1,15 @@
 package s3zip
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -14,12 +17,13 @@ import (
 	"log/slog"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/dustin/go-humanize"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const (
@@ -27,28 +31,82 @@ const (
 	DefaultConcurrency      = 1
 )
 
+// maxChangedRetries is the number of times an object whose files change while it is uploaded is uploaded again.
+const maxChangedRetries = 2
+
 type (
 	RunInput struct {
 		DryRun           bool
 		S3Bucket         string
-		S3Service        *s3.S3
+		S3Service        s3iface.S3API
 		MetadataStoreKey string
 		Path             string
 		MaxZipDepth      int
 		OutPrefix        string
 		S3StorageClass   string
 		Concurrency      int
+		Version          string
+		HashMode         HashMode
+		Format           Format
+		Compression      Compression
+		// StripAttributes omits the modification times, permissions and ownership of the files from the archives.
+		StripAttributes bool
+		Symlinks        SymlinkPolicy
+		// Reproducible makes the archives byte-reproducible, see PackOptions.
+		Reproducible bool
+		// MaxArchiveSize splits the objects whose files are larger than this number of bytes into parts,
+		// each archived on its own. 0 disables it.
+		MaxArchiveSize int64
+		// MinArchiveSize packs the sibling objects whose files are smaller than this number of bytes together
+		// into pack archives. 0 disables it.
+		MinArchiveSize int64
+		// DepthRules override MaxZipDepth in the subtrees of the target.
+		DepthRules []DepthRule
+		// AutoDepth selects the objects by their sizes instead of MaxZipDepth, which must be 0, if it is not nil.
+		AutoDepth *AutoDepth
+		// Filter selects the files of the target, which are the only ones hashed and archived.
+		Filter Filter
+		// MinAge skips the objects whose files have been modified within this duration, 0 disables it.
+		// Their archives are kept as they are until they are old enough.
+		MinAge time.Duration
+
+		// HashCache caches the hashes of unchanged objects between runs, nil disables it.
+		HashCache *HashCache
+		// Rehash ignores the cached hashes and hashes all objects again, updating the cache.
+		Rehash bool
+
+		// CheckpointUploads saves the metadata store after every this number of uploads, 0 disables it.
+		CheckpointUploads int
+		// CheckpointInterval saves the metadata store after an upload if this duration has passed since the last save, 0 disables it.
+		CheckpointInterval time.Duration
 	}
 
 	RunOutput struct {
 		Upload int
 		Delete int
+		// Rename is the number of archives copied from the archives of renamed or moved objects instead of uploading.
+		Rename int
+		// TooNew is the number of objects skipped as they have been modified within the minimum age.
+		TooNew int
+		// Dirty is the number of archives whose files kept changing while they were uploaded.
+		// They are marked dirty in the metadata store, or not uploaded, and are uploaded again by the next run.
+		Dirty int
 	}
 
 	ObjectToUpload struct {
 		Name string
+		// Key is the S3 key of the archive.
+		Key  string
 		Hash string
 		Size int
+		// Part is set if the archive is a part of the object, and Pack if it is a pack of the objects in the directory Name.
+		// Their entries are in entries.
+		Part    *Part
+		Pack    *PackContents
+		entries []walkEntry
+		// RenamedFrom is the S3 key of the archive of a removed object with the same hash,
+		// which is copied instead of uploading the object.
+		RenamedFrom string
 	}
 
 	runClient struct {
@@ -57,18 +115,49 @@ type (
 		s3Bucket       string
 		s3StorageClass string
 
-		s3Service  *s3.S3
+		s3Service  s3iface.S3API
 		s3Uploader *s3manager.Uploader
 
-		metadataStoreKey string
-		metadataStore    *MetadataStore
-		mu               sync.Mutex
-
-		path        string
-		maxZipDepth int
-		outPrefix   string
+		metadataStorage *metadataStorage
+		metadataStore   *MetadataStore
+		mu              sync.Mutex
+
+		path            string
+		maxZipDepth     int
+		depthRules      []DepthRule
+		autoDepth       *AutoDepth
+		outPrefix       string
+		hashMode        HashMode
+		format          Format
+		compression     Compression
+		stripAttributes bool
+		reproducible    bool
+		maxArchiveSize  int64
+		minArchiveSize  int64
+		symlinks        SymlinkPolicy
+		filter          Filter
+		minAge          time.Duration
+		hashCache       *HashCache
+		rehash          bool
 
 		concurrency int
+		version     string
+
+		checkpointUploads  int
+		checkpointInterval time.Duration
+		// uploadsSinceCheckpoint and lastCheckpoint are guarded by mu.
+		uploadsSinceCheckpoint int
+		lastCheckpoint         time.Time
+		// checkpointMu is held while a checkpoint is saved.
+		checkpointMu sync.Mutex
+
+		// renamed is the number of copied archives, guarded by mu.
+		renamed int
+		// tooNew is the number of objects skipped by the minimum age.
+		tooNew int
+		// uploaded and dirty are the numbers of uploaded and dirty archives, guarded by mu.
+		uploaded int
+		dirty    int
 	}
 )
 
@@ -84,21 +173,39 @@ func newRunClient(in *RunInput) *runClient {
 			u.PartSize = 64 * 1024 * 1024
 		}),
 
-		metadataStoreKey: in.MetadataStoreKey,
-
-		path:        in.Path,
-		maxZipDepth: in.MaxZipDepth,
-		outPrefix:   in.OutPrefix,
+		metadataStorage: newMetadataStorage(in.S3Service, in.S3Bucket, in.MetadataStoreKey),
+
+		path:            in.Path,
+		maxZipDepth:     in.MaxZipDepth,
+		depthRules:      in.DepthRules,
+		autoDepth:       in.AutoDepth,
+		outPrefix:       in.OutPrefix,
+		hashMode:        in.HashMode,
+		format:          in.Format.orDefault(),
+		compression:     in.Compression,
+		stripAttributes: in.StripAttributes,
+		reproducible:    in.Reproducible,
+		maxArchiveSize:  in.MaxArchiveSize,
+		minArchiveSize:  in.MinArchiveSize,
+		symlinks:        in.Symlinks.orDefault(),
+		filter:          in.Filter,
+		minAge:          in.MinAge,
+		hashCache:       in.HashCache,
+		rehash:          in.Rehash,
 
 		concurrency: in.Concurrency,
-	}
+		version:     in.Version,
 
-	if c.metadataStoreKey == "" {
-		c.metadataStoreKey = DefaultMetadataStoreKey
+		checkpointUploads:  in.CheckpointUploads,
+		checkpointInterval: in.CheckpointInterval,
 	}
+
 	if c.concurrency == 0 {
 		c.concurrency = DefaultConcurrency
 	}
+	if c.hashMode == "" {
+		c.hashMode = HashModeSize
+	}
 
 	return &c
 }
@@ -107,16 +214,48 @@ func Run(ctx context.Context, in *RunInput) (*RunOutput, error) {
 	return newRunClient(in).run(ctx)
 }
 
-func (c *runClient) run(ctx context.Context) (*RunOutput, error) {
-	objects, err := LocalObjects(c.path, c.maxZipDepth)
-	if err != nil {
-		return nil, fmt.Errorf("list local objects: %w", err)
+func (c *runClient) run(ctx context.Context) (_ *RunOutput, err error) {
+	if err := c.format.validate(); err != nil {
+		return nil, err
+	}
+	if err := c.symlinks.validate(); err != nil {
+		return nil, err
+	}
+	if err := c.compression.validate(); err != nil {
+		return nil, fmt.Errorf("compression: %w", err)
+	}
+	if err := c.filter.validate(); err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	if c.minArchiveSize > 0 && c.maxArchiveSize > 0 && c.minArchiveSize > c.maxArchiveSize {
+		return nil, fmt.Errorf("minimum archive size %d is larger than the maximum %d", c.minArchiveSize, c.maxArchiveSize)
+	}
+
+	if c.autoDepth != nil {
+		if c.maxZipDepth != 0 || len(c.depthRules) > 0 {
+			return nil, errors.New("auto depth is exclusive with max zip depth and depth rules")
+		}
+		if err := c.autoDepth.validate(); err != nil {
+			return nil, fmt.Errorf("auto depth: %w", err)
+		}
 	}
-	slog.InfoContext(ctx, "Listed objects", "len", len(objects))
 
-	if err := c.loadMetadataStore(ctx); err != nil {
+	// The metadata store is loaded first, as the auto depth mode keeps the directories of the previous run.
+	c.metadataStore, err = c.metadataStorage.load(ctx)
+	if err != nil {
 		return nil, fmt.Errorf("load metadata store: %w", err)
 	}
+
+	var objects []string
+	if c.autoDepth != nil {
+		objects, err = AutoLocalObjects(c.path, *c.autoDepth, c.symlinks, c.filter, c.descendedDirs())
+	} else {
+		objects, err = LocalObjects(c.path, c.maxZipDepth, c.depthRules, c.symlinks, c.filter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list local objects: %w", err)
+	}
+	slog.InfoContext(ctx, "Listed objects", "len", len(objects))
 	defer func() {
 		if c.dryRun {
 			return
@@ -127,148 +266,373 @@ func (c *runClient) run(ctx context.Context) (*RunOutput, error) {
 
 		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
 		defer cancel()
-		if err := c.saveMetadataStore(ctx, c.metadataStore); err != nil {
-			slog.ErrorContext(ctx, "save metadata store", "error", err)
+		// A failed save must fail the run, otherwise the uploads are forgotten
+		// or the entries of another host are lost.
+		if serr := c.metadataStorage.save(ctx, c.metadataStore); serr != nil {
+			err = errors.Join(err, fmt.Errorf("save metadata store: %w", serr))
+			return
 		}
 		slog.InfoContext(ctx, "Saved metadata store")
 	}()
 
-	objectsToUpload, err := c.listObjectsToUpload(ctx, objects)
+	objectsToUpload, local, err := c.listObjectsToUpload(ctx, objects)
 	if err != nil {
 		return nil, fmt.Errorf("list objects to upload: %w", err)
 	}
 	slog.InfoContext(ctx, "Listed objects to upload", "len", len(objectsToUpload))
+	if c.hashCache != nil {
+		// All local objects have been hashed, so the cached hashes of the others are stale.
+		if n, err := c.hashCache.prune(c.path); err != nil {
+			slog.WarnContext(ctx, "Failed to prune hash cache", "error", err)
+		} else if n > 0 {
+			slog.InfoContext(ctx, "Pruned hash cache", "len", n)
+		}
+	}
 
 	if err := c.uploadObjects(ctx, objectsToUpload); err != nil {
 		return nil, fmt.Errorf("upload objects: %w", err)
 	}
 
-	deletedLen, err := c.cleanUnusedObjects(ctx, objects)
+	deletedLen, err := c.cleanUnusedObjects(ctx, local)
 	if err != nil {
 		return nil, fmt.Errorf("clean unused objects: %w", err)
 	}
 	return &RunOutput{
-		Upload: len(objectsToUpload),
+		Upload: c.uploaded,
 		Delete: deletedLen,
+		Rename: c.renamed,
+		TooNew: c.tooNew,
+		Dirty:  c.dirty,
 	}, nil
 }
 
-func (c *runClient) listObjectsToUpload(ctx context.Context, objects []string) ([]ObjectToUpload, error) {
+// listObjectsToUpload returns the archives of the objects which are changed since they were uploaded,
+// and the S3 keys of the archives of all objects.
+// The format is a part of the S3 key, so all objects are uploaded again when the format is changed.
+// The objects which are too new by the minimum age are skipped, keeping their archives.
+func (c *runClient) listObjectsToUpload(ctx context.Context, objects []string) ([]ObjectToUpload, map[string]struct{}, error) {
 	res := make([]ObjectToUpload, 0, len(objects))
+	local := make(map[string]struct{}, len(objects))
+	add := func(keys []string, uploads []ObjectToUpload) {
+		for _, key := range keys {
+			local[key] = struct{}{}
+		}
+		res = append(res, uploads...)
+	}
+	parts := c.listNumbered(func(k archiveKey) int { return k.part })
+	var small []localObject
+	tooNew := make(map[string]bool)
+	now := time.Now()
 
-	eg, ctx := errgroup.WithContext(ctx)
+	eg, egCtx := errgroup.WithContext(ctx)
 	eg.SetLimit(c.concurrency)
 
 	for _, object := range objects {
 		eg.Go(func() error {
-			if ctx.Err() != nil {
-				return ctx.Err()
+			if egCtx.Err() != nil {
+				return egCtx.Err()
 			}
 
-			objectHash, err := Hash(filepath.Join(c.path, object))
+			// The modification time comes from the walk of the hash, or of its fingerprint in the hash cache.
+			objectHash, size, modified, err := c.hash(object)
 			if err != nil {
 				return fmt.Errorf("compute hash %q: %w", object, err)
 			}
-			key := makeS3Key(c.path, c.outPrefix, object)
-
-			c.mu.Lock()
-			defer c.mu.Unlock()
-
-			if m, ok := c.metadataStore.Metadata[key]; ok && m.Hash == objectHash {
+			if c.minAge > 0 && now.Sub(modified) < c.minAge {
+				slog.InfoContext(egCtx, "Skipping too new object", "name", object, "modified", modified)
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				tooNew[object] = true
 				return nil
 			}
 
-			size, err := Size(filepath.Join(c.path, object))
+			if c.minArchiveSize > 0 && object != "." {
+				if int64(size) < c.minArchiveSize {
+					c.mu.Lock()
+					defer c.mu.Unlock()
+					small = append(small, localObject{name: object, hash: objectHash, size: size})
+					return nil
+				}
+			}
+
+			keys, uploads, err := c.planObject(egCtx, object, objectHash, size, parts[object])
 			if err != nil {
-				return fmt.Errorf("compute size %q: %w", object, err)
+				return err
 			}
 
-			res = append(res, ObjectToUpload{
-				Name: object,
-				Hash: objectHash,
-				Size: size,
-			})
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			add(keys, uploads)
 			return nil
 		})
 	}
 
 	if err := eg.Wait(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return res, nil
-}
 
-func (c *runClient) loadMetadataStore(ctx context.Context) error {
-	slog.DebugContext(ctx, "Loading metadata store", "key", c.metadataStoreKey)
+	c.tooNew = len(tooNew)
+	kept := c.tooNewArchives(tooNew)
+	for key := range kept {
+		local[key] = struct{}{}
+	}
 
-	out, err := c.s3Service.GetObjectWithContext(ctx, &s3.GetObjectInput{
-		Bucket: &c.s3Bucket,
-		Key:    aws.String(c.metadataStoreKey),
+	if len(small) > 0 {
+		keys, uploads, singles, err := c.planPacks(ctx, small, kept)
+		if err != nil {
+			return nil, nil, fmt.Errorf("plan packs: %w", err)
+		}
+		add(keys, uploads)
+		for _, o := range singles {
+			keys, uploads, err := c.planObject(ctx, o.name, o.hash, o.size, parts[o.name])
+			if err != nil {
+				return nil, nil, err
+			}
+			add(keys, uploads)
+		}
+	}
+
+	// Hash is relative to the object, so an archive of a removed object with the same hash
+	// is the archive of a renamed or moved object, if it is in the same format.
+	// The hashes of parts and packs are not the hashes of objects, so they are only matched with parts and packs.
+	// A dirty archive does not match its hash, so it is never copied.
+	removed := make(map[renameKey]string) // to S3 key
+	for key, m := range c.metadataStore.Metadata {
+		if _, ok := parseS3Key(c.path, c.outPrefix, key); !ok || m.Hash == "" || m.Dirty {
+			continue
+		}
+		if f, _ := formatOf(key); f != c.format {
+			continue
+		}
+		if _, ok := local[key]; !ok {
+			removed[renameKey{hash: m.Hash, part: m.Part != nil, pack: m.Pack != nil}] = key
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key < res[j].Key
 	})
-	if err != nil {
-		var aerr awserr.Error
-		if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
-			slog.InfoContext(ctx, "Metadata store not found, creating a new one")
-			c.metadataStore = &MetadataStore{
-				Metadata: make(map[string]*Metadata),
+	for i, v := range res {
+		k := renameKey{hash: v.Hash, part: v.Part != nil, pack: v.Pack != nil}
+		key, ok := removed[k]
+		if !ok {
+			continue
+		}
+		renamed, err := c.renamedFrom(v, c.metadataStore.Metadata[key])
+		if err != nil {
+			return nil, nil, fmt.Errorf("compare with %q: %w", key, err)
+		}
+		if !renamed {
+			slog.InfoContext(ctx, "Archive with the same hash has other files, uploading", "name", v.Name, "s3-key", key)
+			continue
+		}
+		res[i].RenamedFrom = key
+		delete(removed, k) // an archive is copied once
+	}
+	return res, local, nil
+}
+
+// renamedFrom reports whether the archive with the metadata m, which has the same hash as v, is an archive of the files of v.
+// Only a hash in HashModeContent identifies the files, otherwise two objects with the same file names and sizes have the same hash,
+// so the sizes and modification times of the files are compared with the manifest of the archive.
+func (c *runClient) renamedFrom(v ObjectToUpload, m *Metadata) (bool, error) {
+	if c.hashMode == HashModeContent && HashMode(m.HashMode) == HashModeContent {
+		return true, nil
+	}
+	entries := v.entries
+	if entries == nil {
+		var err error
+		entries, _, err = objectEntries(filepath.Join(c.path, v.Name), c.symlinks, c.filter.under(v.Name))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	manifest := make(map[string]*Entry, len(m.Entries))
+	for _, e := range m.Entries {
+		manifest[e.Name] = e
+	}
+	files := 0
+	for _, e := range entries {
+		if e.kind != walkFile {
+			continue
+		}
+		name := e.rel
+		if name == "." {
+			name = path.Base(v.Name)
+		}
+		me, ok := manifest[name]
+		if !ok || me.Size != e.info.Size() || !me.GetModified().AsTime().Equal(e.info.ModTime()) {
+			return false, nil
+		}
+		files++
+	}
+	// The objects without files are uploaded again, they are small anyway.
+	return files > 0, nil
+}
+
+// renameKey identifies the archives which can be copied to each other on a rename.
+type renameKey struct {
+	hash       string
+	part, pack bool
+}
+
+// tooNewArchives returns the S3 keys of the archives of the objects which are too new, including the packs of which they are members.
+func (c *runClient) tooNewArchives(tooNew map[string]bool) map[string]bool {
+	keys := make(map[string]bool)
+	if len(tooNew) == 0 {
+		return keys
+	}
+	for key, m := range c.metadataStore.Metadata {
+		k, ok := parseArchiveKey(c.path, c.outPrefix, key)
+		if !ok {
+			continue
+		}
+		if k.pack == 0 {
+			if tooNew[k.object] {
+				keys[key] = true
+			}
+			continue
+		}
+		for _, member := range m.GetPack().GetMembers() {
+			if tooNew[path.Join(k.object, member.Name)] {
+				keys[key] = true
+				break
 			}
-			return nil
 		}
+	}
+	return keys
+}
 
-		return fmt.Errorf("get metadata from s3: %w", err)
+// descendedDirs returns whether the previous run descended into a directory, given by its path relative to c.path,
+// which is the case if it is an ancestor of an uploaded object or the directory of a pack.
+func (c *runClient) descendedDirs() func(string) bool {
+	dirs := make(map[string]bool)
+	for key := range c.metadataStore.Metadata {
+		k, ok := parseArchiveKey(c.path, c.outPrefix, key)
+		if !ok {
+			continue
+		}
+		dir := k.object
+		if k.pack == 0 {
+			if dir == "." {
+				continue
+			}
+			dir = path.Dir(dir)
+		}
+		for ; dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+		dirs["."] = true
+	}
+	return func(dir string) bool {
+		return dirs[dir]
 	}
+}
 
-	b, err := io.ReadAll(out.Body)
-	if err != nil {
-		return fmt.Errorf("read body: %w", err)
+// planObject returns the S3 keys of the archives of the object, and the archives to upload as the object is changed.
+// parts are the uploaded parts of the object by number, if it has been split.
+func (c *runClient) planObject(ctx context.Context, object, objectHash string, size int, parts map[int]*Metadata) ([]string, []ObjectToUpload, error) {
+	if c.maxArchiveSize > 0 {
+		if int64(size) > c.maxArchiveSize {
+			keys, uploads, err := c.planParts(ctx, object, objectHash, parts)
+			if err != nil || keys != nil {
+				return keys, uploads, err
+			}
+		}
 	}
 
-	var s MetadataStore
-	if err := proto.Unmarshal(b, &s); err != nil {
-		return fmt.Errorf("unmarshal: %w", err)
+	key := makeS3Key(c.path, c.outPrefix, object, c.format)
+	c.mu.Lock()
+	m, ok := c.metadataStore.Metadata[key]
+	c.mu.Unlock()
+	if ok {
+		unchanged, err := c.unchanged(ctx, object, m, objectHash, func(mode HashMode) (string, error) {
+			return Hash(filepath.Join(c.path, object), mode, c.symlinks, c.filter.under(object))
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("compare hash %q: %w", object, err)
+		}
+		if unchanged {
+			return []string{key}, nil, nil
+		}
 	}
 
-	c.metadataStore = &s
-	slog.InfoContext(ctx, "Loaded metadata store", "len", len(c.metadataStore.Metadata))
+	return []string{key}, []ObjectToUpload{{
+		Name: object,
+		Key:  key,
+		Hash: objectHash,
+		Size: size,
+	}}, nil
+}
 
-	return nil
+// hash returns the hash of the object, its size and its newest modification time.
+func (c *runClient) hash(object string) (string, int, time.Time, error) {
+	if c.hashCache != nil {
+		return c.hashCache.hash(filepath.Join(c.path, object), c.hashMode, c.symlinks, c.filter.under(object), c.rehash)
+	}
+	return hashObject(filepath.Join(c.path, object), c.hashMode, c.symlinks, c.filter.under(object), c.digest)
 }
 
-func (c *runClient) saveMetadataStore(ctx context.Context, s *MetadataStore) error {
-	b, err := proto.Marshal(s)
-	if err != nil {
-		return fmt.Errorf("marshal: %w", err)
+// unchanged reports whether the archive is unchanged since it was uploaded with the metadata m, given its current hash.
+// If m was hashed with another mode, the archive is hashed again with that mode by hashWith,
+// and if it is unchanged the metadata is migrated to the current mode without uploading again.
+func (c *runClient) unchanged(ctx context.Context, name string, m *Metadata, hash string, hashWith func(HashMode) (string, error)) (bool, error) {
+	mode := HashMode(m.HashMode)
+	if mode == "" {
+		mode = HashModeSize
+	}
+	if m.Dirty {
+		return false, nil
+	}
+	if mode == c.hashMode {
+		return m.Hash == hash, nil
 	}
 
-	_, err = c.s3Uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-		Bucket:       &c.s3Bucket,
-		Key:          aws.String(c.metadataStoreKey),
-		Body:         aws.ReadSeekCloser(io.NopCloser(bytes.NewReader(b))),
-		ContentType:  aws.String("application/protobuf"),
-		StorageClass: aws.String(s3.StorageClassStandard),
-	})
+	oldHash, err := hashWith(mode)
 	if err != nil {
-		return fmt.Errorf("put object: %w", err)
+		return false, err
 	}
-	return nil
+	if oldHash != m.Hash {
+		return false, nil
+	}
+
+	slog.InfoContext(ctx, "Migrating hash mode", "name", name, "from", mode, "to", c.hashMode)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m.Hash = hash
+	m.HashMode = string(c.hashMode)
+	return true, nil
 }
 
 func (c *runClient) uploadObjects(ctx context.Context, objects []ObjectToUpload) error {
 	eg, ctx := errgroup.WithContext(ctx)
 	eg.SetLimit(c.concurrency)
 
+	c.lastCheckpoint = time.Now()
+
 	for _, v := range objects {
 		eg.Go(func() error {
-			if err := c.uploadObject(ctx, v); err != nil {
+			m, copied, err := c.copyOrUploadObject(ctx, v)
+			if err != nil {
 				return fmt.Errorf("upload %q: %w", v.Name, err)
 			}
 
+			if m == nil {
+				return nil // not uploaded as its files kept changing
+			}
+
 			c.mu.Lock()
-			c.metadataStore.Metadata[makeS3Key(c.path, c.outPrefix, v.Name)] = &Metadata{
-				Hash: v.Hash,
+			if copied {
+				c.renamed++
+			} else {
+				c.uploaded++
 			}
+			m.Part, m.Pack = v.Part, v.Pack
+			c.metadataStore.Metadata[v.Key] = m
+			c.uploadsSinceCheckpoint++
 			c.mu.Unlock()
 
+			c.checkpoint(ctx)
 			return nil
 		})
 	}
@@ -276,34 +640,232 @@ func (c *runClient) uploadObjects(ctx context.Context, objects []ObjectToUpload)
 	return eg.Wait()
 }
 
-func (c *runClient) uploadObject(ctx context.Context, v ObjectToUpload) error {
+// checkpoint saves the metadata store if enough uploads have been made or enough time has passed since the last save,
+// so that the progress of long uploads survives crashes. A snapshot of the store is saved without holding mu,
+// and a failure is only logged, as the store is saved again at the end of the run.
+func (c *runClient) checkpoint(ctx context.Context) {
+	if c.dryRun {
+		return
+	}
+	// A checkpoint which is being saved is not waited for, so that an older snapshot never overwrites a newer one.
+	if !c.checkpointMu.TryLock() {
+		return
+	}
+	defer c.checkpointMu.Unlock()
+
+	c.mu.Lock()
+	byUploads := c.checkpointUploads > 0 && c.uploadsSinceCheckpoint >= c.checkpointUploads
+	byInterval := c.checkpointInterval > 0 && time.Since(c.lastCheckpoint) >= c.checkpointInterval
+	if !byUploads && !byInterval {
+		c.mu.Unlock()
+		return
+	}
+	uploads := c.uploadsSinceCheckpoint
+	c.uploadsSinceCheckpoint, c.lastCheckpoint = 0, time.Now()
+	snapshot := proto.Clone(c.metadataStore).(*MetadataStore)
+	c.mu.Unlock()
+
+	slog.InfoContext(ctx, "Saving metadata store checkpoint", "uploads", uploads)
+	base := &MetadataStore{Metadata: snapshot.Metadata}
+	merged, err := c.metadataStorage.saveMerging(ctx, snapshot)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to save metadata store checkpoint", "error", err)
+		return
+	}
+	if merged {
+		// The changes of another host have been saved with the snapshot, so they are kept in the store too.
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err := mergeChanges(base, snapshot, c.metadataStore); err != nil {
+			slog.WarnContext(ctx, "Failed to merge metadata store checkpoint", "error", err)
+		}
+	}
+}
+
+// copyOrUploadObject copies the archive of a renamed object, or uploads the object, and reports whether it is copied.
+// An archive in a Glacier storage class cannot be copied unless it is restored, then the object is uploaded.
+func (c *runClient) copyOrUploadObject(ctx context.Context, v ObjectToUpload) (*Metadata, bool, error) {
+	if v.RenamedFrom != "" {
+		c.mu.Lock()
+		src := c.metadataStore.Metadata[v.RenamedFrom]
+		c.mu.Unlock()
+
+		m, err := c.copyArchive(ctx, v, v.RenamedFrom, src)
+		if err == nil {
+			return m, true, nil
+		}
+		if !isInvalidObjectState(err) {
+			return nil, false, fmt.Errorf("copy from %q: %w", v.RenamedFrom, err)
+		}
+		slog.InfoContext(ctx, "Renamed archive is not restored, uploading instead", "name", v.Name, "from", v.RenamedFrom)
+	}
+
+	m, err := c.uploadVerified(ctx, v)
+	return m, false, err
+}
+
+// uploadVerified uploads the object, and hashes it again after the upload to detect the files changed while they were archived.
+// A changed object is uploaded again with its new hash up to maxChangedRetries times. Then the metadata of the archive is marked dirty,
+// or no metadata is returned if a file changed while it was read, as the upload is aborted.
+func (c *runClient) uploadVerified(ctx context.Context, v ObjectToUpload) (*Metadata, error) {
+	for retry := 0; ; retry++ {
+		m, err := c.uploadObject(ctx, v)
+		changed := errors.Is(err, ErrFileChanged)
+		if err != nil && !changed {
+			return nil, err
+		}
+		if c.dryRun {
+			return m, nil
+		}
+
+		fresh, err := c.refreshUpload(v)
+		if err != nil {
+			return nil, fmt.Errorf("compute hash again: %w", err)
+		}
+		if !changed && fresh.Hash == v.Hash {
+			return m, nil
+		}
+
+		if retry == maxChangedRetries {
+			slog.WarnContext(ctx, "Files kept changing while they were archived", "name", v.Name, "key", v.Key, "uploaded", !changed)
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.dirty++
+			if changed {
+				return nil, nil
+			}
+			m.Dirty = true
+			return m, nil
+		}
+		slog.InfoContext(ctx, "Files changed while they were archived, uploading again", "name", v.Name, "key", v.Key)
+		v = fresh
+	}
+}
+
+// refreshUpload returns the archive to upload with the current hash, size and entries of its files.
+func (c *runClient) refreshUpload(v ObjectToUpload) (ObjectToUpload, error) {
+	name := filepath.Join(c.path, v.Name)
+	switch {
+	case v.Pack != nil:
+		objects := make([]localObject, len(v.Pack.Members))
+		for i, member := range v.Pack.Members {
+			object := path.Join(v.Name, member.Name)
+			h, err := hash(filepath.Join(c.path, object), c.hashMode, c.symlinks, c.filter.under(object), c.digest)
+			if err != nil {
+				return ObjectToUpload{}, err
+			}
+			size, err := Size(filepath.Join(c.path, object), c.symlinks, c.filter.under(object))
+			if err != nil {
+				return ObjectToUpload{}, err
+			}
+			objects[i] = localObject{name: object, hash: h, size: size}
+		}
+		return c.packToUpload(v.Name, v.Key, objects)
+	case v.Part != nil:
+		entries, err := statEntries(v.entries)
+		if err != nil {
+			return ObjectToUpload{}, err
+		}
+		lines, err := hashLines(name, entries, c.hashMode, c.digest)
+		if err != nil {
+			return ObjectToUpload{}, err
+		}
+		v.Hash, v.Size, v.entries = sumHashLines(lines), int(entriesSize(entries)), entries
+		return v, nil
+	default:
+		h, err := hash(name, c.hashMode, c.symlinks, c.filter.under(v.Name), c.digest)
+		if err != nil {
+			return ObjectToUpload{}, err
+		}
+		size, err := Size(name, c.symlinks, c.filter.under(v.Name))
+		if err != nil {
+			return ObjectToUpload{}, err
+		}
+		v.Hash, v.Size = h, size
+		return v, nil
+	}
+}
+
+// uploadObject archives and uploads the object, and returns the metadata of the uploaded archive.
+func (c *runClient) uploadObject(ctx context.Context, v ObjectToUpload) (*Metadata, error) {
 	slog.InfoContext(ctx, "Uploading", "name", v.Name, "size", humanize.Bytes(uint64(v.Size)))
 	if c.dryRun {
-		return nil
+		return &Metadata{Hash: v.Hash, HashMode: string(c.hashMode)}, nil
 	}
 
-	r := Zip(filepath.Join(c.path, v.Name))
-	defer r.Close()
+	kind := objectKindDir
+	if v.Part == nil && v.Pack == nil {
+		var err error
+		if kind, err = objectKind(filepath.Join(c.path, v.Name), c.symlinks); err != nil {
+			return nil, fmt.Errorf("stat: %w", err)
+		}
+	}
 
+	r := pack(filepath.Join(c.path, v.Name), v.entries, PackOptions{
+		Format:          c.format,
+		Compression:     c.compression,
+		StripAttributes: c.stripAttributes,
+		Symlinks:        c.symlinks,
+		Filter:          c.filter.under(v.Name),
+		Reproducible:    c.reproducible,
+	})
+	defer r.Close()
+	sum := sha256.New()
+	cr := &countingReader{r: io.TeeReader(r, sum)}
+
+	m := &Metadata{
+		Hash:         v.Hash,
+		HashMode:     string(c.hashMode),
+		StorageClass: c.s3StorageClass,
+		SourceSize:   int64(v.Size),
+		Version:      c.version,
+		ObjectKind:   kind,
+		Pack:         v.Pack,
+	}
 	in := &s3manager.UploadInput{
 		Bucket:       &c.s3Bucket,
-		Key:          aws.String(makeS3Key(c.path, c.outPrefix, v.Name)),
-		Body:         r,
-		ContentType:  aws.String("application/zip"),
+		Key:          aws.String(v.Key),
+		Body:         cr,
+		ContentType:  aws.String(c.format.ContentType()),
 		StorageClass: &c.s3StorageClass,
+		Metadata:     archiveUserMetadata(m),
 	}
-	if _, err := c.s3Uploader.UploadWithContext(ctx, in); err != nil {
-		return fmt.Errorf("upload to s3: %w", err)
+	out, err := c.s3Uploader.UploadWithContext(ctx, in)
+	if err != nil {
+		// The uploader does not wrap the errors of the body.
+		if errors.Is(cr.err, ErrFileChanged) {
+			return nil, fmt.Errorf("archive: %w", cr.err)
+		}
+		return nil, fmt.Errorf("upload to s3: %w", err)
 	}
-	return nil
+
+	m.Entries = r.Entries()
+	m.Size = cr.n
+	m.Sha256 = sum.Sum(nil)
+	m.UploadedAt = timestamppb.Now()
+	m.Etag = aws.StringValue(out.ETag)
+	m.VersionId = aws.StringValue(out.VersionID)
+	return m, nil
+}
+
+// countingReader counts the bytes read from r, and records the error of r other than io.EOF.
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
 }
 
-func (c *runClient) cleanUnusedObjects(ctx context.Context, localObjects []string) (int, error) {
-	local := make(map[string]struct{})
-	for _, v := range localObjects {
-		local[makeS3Key(c.path, c.outPrefix, v)] = struct{}{}
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
 	}
+	return n, err
+}
 
+// cleanUnusedObjects deletes the objects under the prefix other than the archives of the local objects at the keys in local.
+func (c *runClient) cleanUnusedObjects(ctx context.Context, local map[string]struct{}) (int, error) {
 	targets := make([]*s3.ObjectIdentifier, 0)
 	err := c.s3Service.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
 		Bucket: &c.s3Bucket,
@@ -340,10 +902,84 @@ func (c *runClient) cleanUnusedObjects(ctx context.Context, localObjects []strin
 			return 0, fmt.Errorf("delete objects: %w", err)
 		}
 		slog.InfoContext(ctx, "Deleted objects", "len", len(targets))
+
+		c.mu.Lock()
+		for _, t := range targets {
+			delete(c.metadataStore.Metadata, *t.Key)
+		}
+		c.mu.Unlock()
 	}
 	return len(targets), nil
 }
 
-func makeS3Key(localPath, outPrefix, object string) string {
-	return filepath.ToSlash(filepath.Join(outPrefix, filepath.Base(localPath), object)) + ".zip"
+func makeS3Key(localPath, outPrefix, object string, format Format) string {
+	return filepath.ToSlash(filepath.Join(outPrefix, filepath.Base(localPath), object)) + format.Ext()
+}
+
+// s3KeyRoot returns the S3 key of the archive of the whole local path without the extension,
+// which is the prefix of the keys of all archives of the local path.
+func s3KeyRoot(localPath, outPrefix string) string {
+	return filepath.ToSlash(filepath.Join(outPrefix, filepath.Base(localPath)))
+}
+
+// makeS3PartKey returns the S3 key of the archive of a part of the object, numbered from 1.
+func makeS3PartKey(localPath, outPrefix, object string, part int, format Format) string {
+	return strings.TrimSuffix(makeS3Key(localPath, outPrefix, object, format), format.Ext()) + fmt.Sprintf(".part-%04d", part) + format.Ext()
+}
+
+// makeS3PackKey returns the S3 key of a pack archive of small objects in the directory, numbered from 1.
+func makeS3PackKey(localPath, outPrefix, dir string, pack int, format Format) string {
+	return filepath.ToSlash(filepath.Join(outPrefix, filepath.Base(localPath), dir, fmt.Sprintf("%s%04d", packKeyPrefix, pack))) + format.Ext()
+}
+
+// packKeyPrefix is the prefix of the base names of pack archives.
+const packKeyPrefix = ".s3zip-pack-"
+
+// archiveKey is a parsed S3 key of an archive.
+type archiveKey struct {
+	// object is the local object, or the directory of the objects of a pack.
+	object string
+	// part is the number of the part of a split object, otherwise 0.
+	part int
+	// pack is the number of the pack of small objects, otherwise 0.
+	pack int
+}
+
+// parseS3Key is the inverse of makeS3Key, makeS3PartKey and makeS3PackKey,
+// it returns the local object of the given S3 key in any format, or the directory of a pack.
+func parseS3Key(localPath, outPrefix, key string) (string, bool) {
+	k, ok := parseArchiveKey(localPath, outPrefix, key)
+	return k.object, ok
+}
+
+// parseArchiveKey is parseS3Key which also returns the part or pack number of the key.
+func parseArchiveKey(localPath, outPrefix, key string) (archiveKey, bool) {
+	root := s3KeyRoot(localPath, outPrefix)
+	format, ok := formatOf(key)
+	if !ok {
+		return archiveKey{}, false
+	}
+	name := strings.TrimSuffix(key, format.Ext())
+
+	var k archiveKey
+	if i := strings.LastIndex(name, "/"+packKeyPrefix); i >= 0 {
+		if n, ok := parseKeyNumber(name[i+1+len(packKeyPrefix):]); ok {
+			name, k.pack = name[:i], n
+		}
+	} else if i := strings.LastIndex(name, ".part-"); i >= 0 {
+		if n, ok := parseKeyNumber(name[i+len(".part-"):]); ok {
+			name, k.part = name[:i], n
+		}
+	}
+	if name == root {
+		k.object = "."
+		return k, true
+	}
+	k.object, ok = strings.CutPrefix(name, root+"/")
+	return k, ok
+}
+
+func parseKeyNumber(s string) (int, bool) {
+	n, err := strconv.Atoi(s)
+	return n, err == nil && n > 0
 }
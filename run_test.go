@@ -4,17 +4,17 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/stretchr/testify/assert"
@@ -30,39 +30,7 @@ func TestRun(t *testing.T) {
 		{path: "baz/d1.txt", content: "d1"},
 	})
 
-	bucketName := fmt.Sprintf("s3zip-test-%d", time.Now().UnixNano())
-	s3svc := s3.New(session.Must(session.NewSession()), &aws.Config{
-		Endpoint:         aws.String("http://localhost:9000"),
-		Region:           aws.String("ap-northeast-1"),
-		Credentials:      credentials.NewStaticCredentials("minioadmin", "minioadmin", ""),
-		S3ForcePathStyle: aws.Bool(true),
-	})
-	_, err := s3svc.CreateBucket(&s3.CreateBucketInput{
-		Bucket: aws.String(bucketName),
-	})
-	require.NoError(t, err)
-	t.Cleanup(func() {
-		keys := make([]*string, 0)
-		require.NoError(t, s3svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
-			Bucket: aws.String(bucketName),
-		}, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
-			for _, object := range output.Contents {
-				keys = append(keys, object.Key)
-			}
-			return lastPage
-		}))
-		for _, key := range keys {
-			_, err := s3svc.DeleteObject(&s3.DeleteObjectInput{
-				Bucket: aws.String(bucketName),
-				Key:    key,
-			})
-			require.NoError(t, err, "delete object %q", *key)
-		}
-		_, err := s3svc.DeleteBucket(&s3.DeleteBucketInput{
-			Bucket: aws.String(bucketName),
-		})
-		require.NoError(t, err)
-	})
+	s3svc, bucketName := setupTestBucket(t)
 
 	in := &RunInput{
 		S3Bucket:         bucketName,
@@ -72,6 +40,7 @@ func TestRun(t *testing.T) {
 		OutPrefix:        "pref",
 		MetadataStoreKey: "metadata.pb",
 		S3StorageClass:   s3.StorageClassStandard,
+		Version:          "test",
 	}
 	defer func() { // remove all objects in the bucket/prefix
 		keys := make([]*s3.ObjectIdentifier, 0)
@@ -167,6 +136,39 @@ func TestRun(t *testing.T) {
 				{path: "d1.txt", content: "d1"},
 			},
 		})
+
+		store, err := newMetadataStorage(s3svc, in.S3Bucket, in.MetadataStoreKey).load(context.Background())
+		require.NoError(t, err)
+		require.Contains(t, store.Metadata, "pref/target/foo.zip")
+		names := make([]string, 0)
+		for _, e := range store.Metadata["pref/target/foo.zip"].Entries {
+			names = append(names, e.Name)
+		}
+		assert.Equal(t, []string{"b1.txt", "b2.txt", "bar/c1.txt"}, names)
+		assert.Greater(t, store.Metadata["pref/target/foo.zip"].Size, int64(0))
+		assert.Equal(t, s3.StorageClassStandard, store.Metadata["pref/target/foo.zip"].StorageClass)
+		assert.NotNil(t, store.Metadata["pref/target/foo.zip"].UploadedAt)
+		assert.Equal(t, 6, int(store.Metadata["pref/target/foo.zip"].SourceSize))
+		assert.NotEmpty(t, store.Metadata["pref/target/foo.zip"].Etag)
+		assert.Equal(t, "test", store.Metadata["pref/target/foo.zip"].Version)
+
+		head, err := s3svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(in.S3Bucket),
+			Key:    aws.String("pref/target/foo.zip"),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, store.Metadata["pref/target/foo.zip"].Hash, metadataFromHead(head).Hash, "hash should be recorded in the user metadata")
+
+		obj, err := s3svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(in.S3Bucket),
+			Key:    aws.String("pref/target/foo.zip"),
+		})
+		require.NoError(t, err)
+		defer obj.Body.Close()
+		b, err := io.ReadAll(obj.Body)
+		require.NoError(t, err)
+		sum := sha256.Sum256(b)
+		assert.Equal(t, sum[:], store.Metadata["pref/target/foo.zip"].Sha256)
 	})
 
 	t.Run("delete", func(t *testing.T) {
@@ -227,4 +229,633 @@ func TestRun(t *testing.T) {
 			},
 		})
 	})
+
+	t.Run("migrate hash mode", func(t *testing.T) {
+		in.HashMode = HashModeContent
+
+		out, err := Run(context.Background(), in)
+		require.NoError(t, err)
+		assert.Equal(t, &RunOutput{
+			Upload: 0,
+			Delete: 0,
+		}, out, "unchanged object should not be uploaded when hash mode is changed")
+
+		store, err := LoadMetadataStore(context.Background(), s3svc, in.S3Bucket, in.MetadataStoreKey)
+		require.NoError(t, err)
+		assert.Equal(t, string(HashModeContent), store.Metadata["pref/target/foo.zip"].HashMode)
+	})
+
+	t.Run("detect file content with content hash mode", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "foo/b1.txt"), []byte("b1"), 0644))
+
+		out, err := Run(context.Background(), in)
+		require.NoError(t, err)
+		assert.Equal(t, &RunOutput{
+			Upload: 1,
+			Delete: 0,
+		}, out)
+		assertS3Objects(t, map[string][]testFile{
+			"pref/target/foo.zip": {
+				{path: "b1.txt", content: "b1"},
+				{path: "b2-2.txt", content: "b2"},
+				{path: "bar/c1.txt", content: "c1"},
+			},
+		})
+	})
+}
+
+func TestRunClientCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	s3svc := newFakeS3()
+	c := newRunClient(&RunInput{
+		S3Bucket:          "bucket",
+		S3Service:         s3svc,
+		CheckpointUploads: 2,
+	})
+
+	var err error
+	c.metadataStore, err = c.metadataStorage.load(ctx)
+	require.NoError(t, err)
+	c.lastCheckpoint = time.Now()
+
+	saved := func(t *testing.T) int {
+		t.Helper()
+
+		s, err := LoadMetadataStore(ctx, s3svc, "bucket", "")
+		require.NoError(t, err)
+		return len(s.Metadata)
+	}
+
+	c.metadataStore.Metadata["a"] = &Metadata{Hash: "a"}
+	c.uploadsSinceCheckpoint++
+	c.checkpoint(ctx)
+	assert.Equal(t, 0, saved(t), "should not be saved before 2 uploads")
+
+	c.metadataStore.Metadata["b"] = &Metadata{Hash: "b"}
+	c.uploadsSinceCheckpoint++
+	c.checkpoint(ctx)
+	assert.Equal(t, 2, saved(t), "should be saved after 2 uploads")
+	assert.Equal(t, 0, c.uploadsSinceCheckpoint)
+
+	c.checkpointUploads = 0
+	c.checkpointInterval = time.Minute
+	c.lastCheckpoint = time.Now().Add(-time.Hour)
+	c.metadataStore.Metadata["c"] = &Metadata{Hash: "c"}
+	c.uploadsSinceCheckpoint++
+	c.checkpoint(ctx)
+	assert.Equal(t, 3, saved(t), "should be saved after the interval")
+
+	other := newMetadataStorage(s3svc, "bucket", "")
+	otherStore, err := other.load(ctx)
+	require.NoError(t, err)
+	otherStore.Metadata["d"] = &Metadata{Hash: "d"}
+	require.NoError(t, other.save(ctx, otherStore))
+
+	c.lastCheckpoint = time.Now().Add(-time.Hour)
+	c.metadataStore.Metadata["e"] = &Metadata{Hash: "e"}
+	c.uploadsSinceCheckpoint++
+	c.checkpoint(ctx)
+	assert.Equal(t, 5, saved(t), "the entry of another host should be merged")
+	assert.Contains(t, c.metadataStore.Metadata, "d", "the merged entry should be kept in the store")
+
+	otherStore, err = other.load(ctx)
+	require.NoError(t, err)
+	otherStore.Metadata["f"] = &Metadata{Hash: "f by another host"}
+	require.NoError(t, other.save(ctx, otherStore))
+
+	c.lastCheckpoint = time.Now().Add(-time.Hour)
+	c.metadataStore.Metadata["f"] = &Metadata{Hash: "f"}
+	c.uploadsSinceCheckpoint++
+	c.checkpoint(ctx) // the conflict is only logged
+	s, err := LoadMetadataStore(ctx, s3svc, "bucket", "")
+	require.NoError(t, err)
+	assert.Equal(t, "f by another host", s.Metadata["f"].Hash)
+}
+
+// newTestRun creates the target directory with the files, and returns it with a fake S3 and the input of a run into it,
+// which archives the entries of the target under "pref". The tests set the options they check on the input.
+func newTestRun(t *testing.T, files []testFile) (string, *fakeS3, *RunInput) {
+	t.Helper()
+
+	dir := setupTestDir(t, "target", files)
+	s3svc := newFakeS3()
+	return dir, s3svc, &RunInput{
+		S3Bucket:       "bucket",
+		S3Service:      s3svc,
+		Path:           dir,
+		MaxZipDepth:    1,
+		OutPrefix:      "pref",
+		S3StorageClass: s3.StorageClassStandard,
+	}
+}
+
+// archivedNames returns the names of the entries of the archive at key recorded in the metadata store of the run.
+func archivedNames(t *testing.T, in *RunInput, key string) []string {
+	t.Helper()
+
+	store, err := LoadMetadataStore(context.Background(), in.S3Service, in.S3Bucket, in.MetadataStoreKey)
+	require.NoError(t, err)
+	require.Contains(t, store.Metadata, key)
+	var names []string
+	for _, e := range store.Metadata[key].Entries {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func TestRunRename(t *testing.T) {
+	ctx := context.Background()
+	dir, s3svc, in := newTestRun(t, []testFile{
+		{path: "2023-trip/a1.txt", content: "a1"},
+		{path: "2023-trip/a2.txt", content: "a2"},
+	})
+	_, err := Run(ctx, in)
+	require.NoError(t, err)
+	archive := s3svc.objects[makeS3Key(dir, "pref", "2023-trip", FormatZip)].body
+
+	rename := func(t *testing.T, from, to string) (string, *RunOutput) {
+		require.NoError(t, os.Rename(filepath.Join(dir, from), filepath.Join(dir, to)))
+		s3svc.copied = 0
+		out, err := Run(ctx, in)
+		require.NoError(t, err)
+		return makeS3Key(dir, "pref", to, FormatZip), out
+	}
+
+	t.Run("copy", func(t *testing.T) {
+		key, out := rename(t, "2023-trip", "2023-japan-trip")
+		assert.Equal(t, &RunOutput{Upload: 0, Delete: 1, Rename: 1}, out)
+		assert.Equal(t, archive, s3svc.objects[key].body)
+		assert.Equal(t, len(archive), s3svc.copied)
+		assert.NotContains(t, s3svc.objects, makeS3Key(dir, "pref", "2023-trip", FormatZip))
+
+		store, err := LoadMetadataStore(ctx, s3svc, in.S3Bucket, in.MetadataStoreKey)
+		require.NoError(t, err)
+		assert.Len(t, store.Metadata, 1)
+		require.Contains(t, store.Metadata, key)
+		assert.Equal(t, s3svc.objects[key].etag, store.Metadata[key].Etag)
+	})
+
+	t.Run("multipart copy", func(t *testing.T) {
+		defer func(size, part int64) { maxCopyObjectSize, copyPartSize = size, part }(maxCopyObjectSize, copyPartSize)
+		maxCopyObjectSize, copyPartSize = 1, 100
+
+		key, out := rename(t, "2023-japan-trip", "2023-trip")
+		assert.Equal(t, &RunOutput{Upload: 0, Delete: 1, Rename: 1}, out)
+		assert.Equal(t, archive, s3svc.objects[key].body)
+		assert.Equal(t, len(archive), s3svc.copied)
+		assert.Empty(t, s3svc.uploads)
+	})
+
+	t.Run("multipart copy without size", func(t *testing.T) {
+		defer func(size, part int64) { maxCopyObjectSize, copyPartSize = size, part }(maxCopyObjectSize, copyPartSize)
+		maxCopyObjectSize, copyPartSize = 1, 100
+
+		// The metadata of older versions has no size of the archive.
+		storage := newMetadataStorage(s3svc, in.S3Bucket, in.MetadataStoreKey)
+		store, err := storage.load(ctx)
+		require.NoError(t, err)
+		store.Metadata[makeS3Key(dir, "pref", "2023-trip", FormatZip)].Size = 0
+		require.NoError(t, storage.save(ctx, store))
+
+		key, out := rename(t, "2023-trip", "2023-old-trip")
+		assert.Equal(t, &RunOutput{Upload: 0, Delete: 1, Rename: 1}, out)
+		assert.Equal(t, archive, s3svc.objects[key].body)
+
+		store, err = LoadMetadataStore(ctx, s3svc, in.S3Bucket, in.MetadataStoreKey)
+		require.NoError(t, err)
+		assert.EqualValues(t, len(archive), store.Metadata[key].Size)
+
+		rename(t, "2023-old-trip", "2023-trip")
+	})
+
+	t.Run("upload archived archive", func(t *testing.T) {
+		s3svc.objects[makeS3Key(dir, "pref", "2023-trip", FormatZip)].storageClass = s3.StorageClassDeepArchive
+
+		key, out := rename(t, "2023-trip", "2023-japan-trip")
+		assert.Equal(t, &RunOutput{Upload: 1, Delete: 1, Rename: 0}, out)
+		assert.Equal(t, 0, s3svc.copied)
+		assert.Contains(t, s3svc.objects, key)
+	})
+
+	t.Run("upload dirty archive", func(t *testing.T) {
+		storage := newMetadataStorage(s3svc, in.S3Bucket, in.MetadataStoreKey)
+		store, err := storage.load(ctx)
+		require.NoError(t, err)
+		store.Metadata[makeS3Key(dir, "pref", "2023-japan-trip", FormatZip)].Dirty = true
+		require.NoError(t, storage.save(ctx, store))
+
+		key, out := rename(t, "2023-japan-trip", "2023-trip")
+		assert.Equal(t, &RunOutput{Upload: 1, Delete: 1, Rename: 0}, out, "a dirty archive should not be copied")
+		assert.Equal(t, 0, s3svc.copied)
+
+		store, err = LoadMetadataStore(ctx, s3svc, in.S3Bucket, in.MetadataStoreKey)
+		require.NoError(t, err)
+		require.Contains(t, store.Metadata, key)
+		assert.False(t, store.Metadata[key].Dirty)
+	})
+
+	t.Run("same names and sizes", func(t *testing.T) {
+		// Another directory with the same hash in HashModeSize, whose files were not renamed.
+		require.NoError(t, os.RemoveAll(filepath.Join(dir, "2023-trip")))
+		for name, content := range map[string]string{"a1.txt": "b1", "a2.txt": "b2"} {
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "2024-trip"), 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "2024-trip", name), []byte(content), 0o644))
+		}
+		s3svc.copied = 0
+		out, err := Run(ctx, in)
+		require.NoError(t, err)
+		assert.Equal(t, &RunOutput{Upload: 1, Delete: 1}, out)
+		assert.Equal(t, 0, s3svc.copied)
+		assert.NotEqual(t, archive, s3svc.objects[makeS3Key(dir, "pref", "2024-trip", FormatZip)].body)
+	})
+}
+
+func TestRunFormat(t *testing.T) {
+	ctx := context.Background()
+	_, s3svc, in := newTestRun(t, []testFile{
+		{path: "foo/a1.txt", content: "a1"},
+	})
+	_, err := Run(ctx, in)
+	require.NoError(t, err)
+
+	in.Format = FormatTarZst
+	out, err := Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{Upload: 1, Delete: 1, Rename: 0}, out, "a format change should upload the object again")
+	assert.Contains(t, s3svc.objects, "pref/target/foo.tar.zst")
+	assert.NotContains(t, s3svc.objects, "pref/target/foo.zip")
+
+	out, err = Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{}, out)
+
+	in.Format = "7z"
+	_, err = Run(ctx, in)
+	assert.Error(t, err)
+}
+
+func TestRunSplit(t *testing.T) {
+	ctx := context.Background()
+	dir, s3svc, in := newTestRun(t, []testFile{
+		{path: "foo/a.txt", content: strings.Repeat("a", 10)},
+		{path: "foo/b.txt", content: strings.Repeat("b", 10)},
+		{path: "foo/c.txt", content: strings.Repeat("c", 10)},
+		{path: "foo/d.txt", content: strings.Repeat("d", 10)},
+		{path: "foo/e.txt", content: strings.Repeat("e", 10)},
+	})
+	in.MaxArchiveSize = 25
+	partKey := func(part int) string {
+		return makeS3PartKey(dir, "pref", "foo", part, FormatZip)
+	}
+
+	out, err := Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{Upload: 3}, out)
+	for part, names := range map[int][]string{1: {"a.txt", "b.txt"}, 2: {"c.txt", "d.txt"}, 3: {"e.txt"}} {
+		assert.Equal(t, names, archivedNames(t, in, partKey(part)), part)
+	}
+	store, err := LoadMetadataStore(ctx, s3svc, in.S3Bucket, in.MetadataStoreKey)
+	require.NoError(t, err)
+	assert.Len(t, store.Metadata, 3)
+	assert.Equal(t, "c.txt", store.Metadata[partKey(2)].Part.First)
+	assert.EqualValues(t, 3, store.Metadata[partKey(2)].Part.Count)
+
+	out, err = Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{}, out)
+
+	t.Run("grow a part", func(t *testing.T) {
+		part1 := s3svc.objects[partKey(1)].etag
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "foo/c.txt"), []byte(strings.Repeat("c", 20)), 0o644))
+
+		out, err := Run(ctx, in)
+		require.NoError(t, err)
+		assert.Equal(t, &RunOutput{Upload: 2}, out, "only the grown part should be uploaded, split in two")
+		assert.Equal(t, part1, s3svc.objects[partKey(1)].etag)
+		assert.Contains(t, s3svc.objects, partKey(4))
+
+		var buf bytes.Buffer
+		got, err := Get(ctx, &GetInput{
+			S3Bucket:  in.S3Bucket,
+			S3Service: s3svc,
+			Path:      dir,
+			OutPrefix: "pref",
+			Name:      "foo/d.txt",
+			Writer:    &buf,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, partKey(4), got.Key)
+		assert.Equal(t, strings.Repeat("d", 10), buf.String())
+
+		dest := t.TempDir()
+		restored, err := Restore(ctx, &RestoreInput{
+			S3Bucket:  in.S3Bucket,
+			S3Service: s3svc,
+			Path:      dir,
+			OutPrefix: "pref",
+			Dest:      dest,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 5, restored.Extract)
+		b, err := os.ReadFile(filepath.Join(dest, "foo/c.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, strings.Repeat("c", 20), string(b))
+	})
+
+	t.Run("shrink below the maximum size", func(t *testing.T) {
+		for _, name := range []string{"b.txt", "c.txt", "d.txt"} {
+			require.NoError(t, os.Remove(filepath.Join(dir, "foo", name)))
+		}
+
+		out, err := Run(ctx, in)
+		require.NoError(t, err)
+		assert.Equal(t, &RunOutput{Upload: 1, Delete: 4}, out)
+		assert.Contains(t, s3svc.objects, makeS3Key(dir, "pref", "foo", FormatZip))
+	})
+}
+
+func TestRunPack(t *testing.T) {
+	ctx := context.Background()
+	dir, s3svc, in := newTestRun(t, []testFile{
+		{path: "a.txt", content: "aaaaa"},
+		{path: "b.txt", content: "bbbbb"},
+		{path: "c.txt", content: "ccccc"},
+		{path: "d.txt", content: "ddddd"},
+		{path: "sub/y.txt", content: "yy"},
+		{path: "big/x.bin", content: strings.Repeat("x", 30)},
+	})
+	in.MinArchiveSize = 10
+	packKey := func(number int) string {
+		return makeS3PackKey(dir, "pref", ".", number, FormatZip)
+	}
+	members := func(t *testing.T) map[string][]string {
+		t.Helper()
+		store, err := LoadMetadataStore(ctx, s3svc, in.S3Bucket, in.MetadataStoreKey)
+		require.NoError(t, err)
+		res := make(map[string][]string)
+		for key, m := range store.Metadata {
+			for _, member := range m.GetPack().GetMembers() {
+				res[key] = append(res[key], member.Name)
+			}
+		}
+		return res
+	}
+
+	out, err := Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{Upload: 3}, out)
+	assert.Equal(t, "pref/target/.s3zip-pack-0001.zip", packKey(1))
+	assert.Equal(t, map[string][]string{
+		packKey(1): {"a.txt", "b.txt"},
+		packKey(2): {"c.txt", "d.txt", "sub"},
+	}, members(t), "the last small object should join the previous pack")
+	assert.Contains(t, s3svc.objects, makeS3Key(dir, "pref", "big", FormatZip))
+
+	out, err = Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{}, out)
+
+	// The members of the packs are rebuilt from their user metadata.
+	delete(s3svc.objects, DefaultMetadataStoreKey)
+	_, err = Reindex(ctx, &ReindexInput{S3Bucket: in.S3Bucket, S3Service: s3svc, Path: dir, OutPrefix: "pref"})
+	require.NoError(t, err)
+	out, err = Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{}, out, "the packs should not be uploaded again after a reindex")
+
+	pack2 := s3svc.objects[packKey(2)].etag
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.txt"), []byte("bbbbbb"), 0o644))
+	out, err = Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{Upload: 1}, out, "only the pack of the changed object should be uploaded")
+	assert.Equal(t, pack2, s3svc.objects[packKey(2)].etag)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "e.txt"), []byte("e"), 0o644))
+	out, err = Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{Upload: 1}, out)
+	assert.Contains(t, s3svc.objects, makeS3Key(dir, "pref", "e.txt", FormatZip), "a single new small object should be archived on its own")
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "a.txt")))
+	out, err = Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{Upload: 1, Delete: 1}, out)
+	assert.Equal(t, map[string][]string{
+		packKey(1): {"b.txt", "e.txt"},
+		packKey(2): {"c.txt", "d.txt", "sub"},
+	}, members(t))
+
+	var buf bytes.Buffer
+	got, err := Get(ctx, &GetInput{
+		S3Bucket:  in.S3Bucket,
+		S3Service: s3svc,
+		Path:      dir,
+		OutPrefix: "pref",
+		Name:      "sub/y.txt",
+		Writer:    &buf,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, packKey(2), got.Key)
+	assert.Equal(t, "yy", buf.String())
+
+	dest := t.TempDir()
+	_, err = Restore(ctx, &RestoreInput{
+		S3Bucket:  in.S3Bucket,
+		S3Service: s3svc,
+		Path:      dir,
+		OutPrefix: "pref",
+		Dest:      dest,
+	})
+	require.NoError(t, err)
+	for name, content := range map[string]string{"b.txt": "bbbbbb", "e.txt": "e", "d.txt": "ddddd", "sub/y.txt": "yy", "big/x.bin": strings.Repeat("x", 30)} {
+		b, err := os.ReadFile(filepath.Join(dest, name))
+		require.NoError(t, err)
+		assert.Equal(t, content, string(b), name)
+	}
+}
+
+func TestRunAutoDepth(t *testing.T) {
+	ctx := context.Background()
+	dir, s3svc, in := newTestRun(t, []testFile{
+		{path: "big/a.bin", content: strings.Repeat("a", 30)},
+		{path: "big/b.bin", content: strings.Repeat("b", 30)},
+		{path: "small/c.txt", content: strings.Repeat("c", 30)},
+	})
+	in.MaxZipDepth, in.AutoDepth = 0, &AutoDepth{MinSize: 40, MaxSize: 50}
+	keys := func() []string {
+		var res []string
+		for key := range s3svc.objects {
+			if object, ok := parseS3Key(dir, "pref", key); ok {
+				res = append(res, object)
+			}
+		}
+		sort.Strings(res)
+		return res
+	}
+
+	out, err := Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{Upload: 3}, out)
+	assert.Equal(t, []string{"big/a.bin", "big/b.bin", "small"}, keys())
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "big/b.bin"), []byte(strings.Repeat("b", 15)), 0o644))
+	out, err = Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{Upload: 1}, out, "a directory within the range should stay descended into")
+	assert.Equal(t, []string{"big/a.bin", "big/b.bin", "small"}, keys())
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "big/a.bin"), []byte(strings.Repeat("a", 15)), 0o644))
+	out, err = Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{Upload: 1, Delete: 2}, out, "a directory below the minimum should be archived as a whole")
+	assert.Equal(t, []string{"big", "small"}, keys())
+
+	in.MaxZipDepth = 1
+	_, err = Run(ctx, in)
+	assert.ErrorContains(t, err, "exclusive")
+}
+
+func TestRunFilter(t *testing.T) {
+	ctx := context.Background()
+	dir, _, in := newTestRun(t, []testFile{
+		{path: "foo/a.txt", content: "a"},
+		{path: "foo/.DS_Store", content: "x"},
+		{path: "foo/node_modules/b.js", content: "b"},
+		{path: "node_modules/c.js", content: "c"},
+		{path: "d.tmp", content: "d"},
+	})
+	in.Filter = Filter{Exclude: []string{"node_modules", ".DS_Store", "*.tmp"}}
+
+	out, err := Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{Upload: 1}, out, "only foo should be an object")
+	assert.Equal(t, []string{"a.txt"}, archivedNames(t, in, makeS3Key(dir, "pref", "foo", FormatZip)))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "foo/.DS_Store"), []byte("changed"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "e.tmp"), []byte("e"), 0o644))
+	out, err = Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{}, out, "excluded files should not trigger uploads")
+
+	in.Filter = Filter{Exclude: []string{"[a"}}
+	_, err = Run(ctx, in)
+	assert.ErrorContains(t, err, "filter")
+}
+
+func TestRunIgnoreFile(t *testing.T) {
+	ctx := context.Background()
+	dir, s3svc, in := newTestRun(t, []testFile{
+		{path: ".s3zipignore", content: "*.tmp\n"},
+		{path: "foo/.s3zipignore", content: "*.log\n"},
+		{path: "foo/a.txt", content: "a"},
+		{path: "foo/b.tmp", content: "b"},
+		{path: "c.tmp", content: "c"},
+	})
+	in.HashCache = newTestHashCache(t)
+
+	out, err := Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{Upload: 1}, out, "only foo should be an object")
+	assert.NotContains(t, s3svc.objects, makeS3Key(dir, "pref", ".s3zipignore", FormatZip))
+	assert.ElementsMatch(t, []string{".s3zipignore", "a.txt"}, archivedNames(t, in, makeS3Key(dir, "pref", "foo", FormatZip)),
+		"the ignore file should be archived with its directory")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "foo/b.tmp"), []byte("changed"), 0o644))
+	out, err = Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{}, out, "ignored files should not trigger uploads")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".s3zipignore"), []byte("*.txt\n"), 0o644))
+	out, err = Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{Upload: 2}, out, "editing the ignore file should upload the affected archives")
+	assert.Contains(t, s3svc.objects, makeS3Key(dir, "pref", "c.tmp", FormatZip))
+}
+
+func TestRunMinAge(t *testing.T) {
+	ctx := context.Background()
+	for _, cached := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cached=%t", cached), func(t *testing.T) {
+			dir, s3svc, in := newTestRun(t, []testFile{
+				{path: "old/a.txt", content: "aaaaaaaaaaaa"},
+				{path: "new/b.txt", content: "bbbbbbbbbbbb"},
+				{path: "c.txt", content: "c"},
+				{path: "d.txt", content: "d"},
+			})
+			old := time.Now().Add(-48 * time.Hour)
+			for _, name := range []string{"old/a.txt", "c.txt", "d.txt"} {
+				require.NoError(t, os.Chtimes(filepath.Join(dir, name), old, old))
+			}
+			in.MinArchiveSize, in.MinAge = 10, 24*time.Hour
+			if cached {
+				// The modification times come from the walks of the fingerprints.
+				in.HashCache = newTestHashCache(t)
+			}
+
+			out, err := Run(ctx, in)
+			require.NoError(t, err)
+			assert.Equal(t, &RunOutput{Upload: 2, TooNew: 1}, out)
+			assert.NotContains(t, s3svc.objects, makeS3Key(dir, "pref", "new", FormatZip))
+
+			require.NoError(t, os.Chtimes(filepath.Join(dir, "new/b.txt"), old, old))
+			out, err = Run(ctx, in)
+			require.NoError(t, err)
+			assert.Equal(t, &RunOutput{Upload: 1}, out, "an object should be uploaded once it is old enough")
+
+			pack := makeS3PackKey(dir, "pref", ".", 1, FormatZip)
+			etag := s3svc.objects[pack].etag
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "c.txt"), []byte("cc"), 0o644))
+			require.NoError(t, os.Chtimes(filepath.Join(dir, "old/a.txt"), time.Now(), time.Now()))
+			out, err = Run(ctx, in)
+			require.NoError(t, err)
+			assert.Equal(t, &RunOutput{TooNew: 2}, out, "the archives of too new objects should be kept")
+			assert.Equal(t, etag, s3svc.objects[pack].etag)
+			assert.Contains(t, s3svc.objects, makeS3Key(dir, "pref", "old", FormatZip))
+		})
+	}
+}
+
+func TestRunFileChanged(t *testing.T) {
+	ctx := context.Background()
+	dir, s3svc, in := newTestRun(t, []testFile{
+		{path: "foo/a.txt", content: "a"},
+	})
+	key := makeS3Key(dir, "pref", "foo", FormatZip)
+	// changes is the number of times a.txt is written while the archive is uploaded, with another size each time.
+	changes := 0
+	s3svc.beforePut = func(k string) {
+		if k != key || changes == 0 {
+			return
+		}
+		changes--
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "foo/a.txt"), []byte(strings.Repeat("a", changes+2)), 0o644))
+	}
+	dirty := func() bool {
+		store, err := LoadMetadataStore(ctx, s3svc, in.S3Bucket, in.MetadataStoreKey)
+		require.NoError(t, err)
+		return store.Metadata[key].GetDirty()
+	}
+
+	changes = 1
+	out, err := Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{Upload: 1}, out, "the archive should be uploaded again with the changed file")
+	assert.False(t, dirty())
+	assert.Zero(t, changes)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "foo/a.txt"), []byte("b"), 0o644))
+	changes = maxChangedRetries + 1
+	out, err = Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{Upload: 1, Dirty: 1}, out)
+	assert.True(t, dirty(), "the archive should be marked dirty once the retries are exhausted")
+
+	out, err = Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{Upload: 1}, out, "a dirty archive should be uploaded again")
+	assert.False(t, dirty())
+
+	out, err = Run(ctx, in)
+	require.NoError(t, err)
+	assert.Equal(t, &RunOutput{}, out)
 }
@@ -1,36 +1,36 @@
 package s3zip
 
-import (
-	"fmt"
-	"os"
-	"path/filepath"
+import "time"
 
-	"golang.org/x/mod/sumdb/dirhash"
-)
-
-// Size returns the size of the given file or directory.
-func Size(name string) (int, error) {
-	stat, err := os.Stat(name)
+// Size returns the total size of the regular files of the given file or directory, by the symlink policy and the filter.
+func Size(name string, symlinks SymlinkPolicy, filter Filter) (int, error) {
+	var size int
+	_, err := walkObject(name, symlinks, filter, true, func(e walkEntry) error {
+		if e.kind == walkFile {
+			size += int(e.info.Size())
+		}
+		return nil
+	})
 	if err != nil {
-		return 0, fmt.Errorf("stat: %w", err)
+		return 0, err
 	}
+	return size, nil
+}
 
-	files := []string{"."}
-	if stat.IsDir() {
-		files, err = dirhash.DirFiles(name, "")
-		if err != nil {
-			return 0, fmt.Errorf("dir files: %w", err)
-		}
+// entriesModTime returns the newest modification time of the regular files and preserved links in the entries of an object.
+// It is the zero time if there are none.
+func entriesModTime(entries []walkEntry) time.Time {
+	var newest time.Time
+	for _, e := range entries {
+		newest = newerModTime(newest, e)
 	}
+	return newest
+}
 
-	var size int
-	for _, file := range files {
-		s, err := os.Stat(filepath.Join(name, file))
-		if err != nil {
-			return 0, err
-		}
-		size += int(s.Size())
+// newerModTime returns the modification time of the entry if it is a file or a link newer than t, otherwise t.
+func newerModTime(t time.Time, e walkEntry) time.Time {
+	if e.kind != walkDir && e.info.ModTime().After(t) {
+		return e.info.ModTime()
 	}
-
-	return size, nil
+	return t
 }
@@ -1,8 +1,10 @@
 package s3zip
 
 import (
+	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -14,11 +16,32 @@ func TestSize(t *testing.T) {
 		{path: "b1.txt", content: "23"},
 	})
 
-	got, err := Size(dir)
+	got, err := Size(dir, SymlinksFollow, Filter{})
 	require.NoError(t, err, "get directory size")
 	assert.Equal(t, 3, got, "directory size mismatch")
 
-	got2, err := Size(filepath.Join(dir, "a1.txt"))
+	got2, err := Size(filepath.Join(dir, "a1.txt"), SymlinksFollow, Filter{})
 	require.NoError(t, err, "get file size")
 	assert.Equal(t, 1, got2, "file size mismatch")
 }
+
+func TestEntriesModTime(t *testing.T) {
+	dir := setupTestDir(t, "", []testFile{
+		{path: "a1.txt", content: "1"},
+		{path: "foo/b1.txt", content: "23"},
+	})
+	older := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "a1.txt"), older, older))
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "foo/b1.txt"), newer, newer))
+
+	entries, _, err := objectEntries(dir, SymlinksFollow, Filter{})
+	require.NoError(t, err)
+	got := entriesModTime(entries)
+	assert.True(t, newer.Equal(got), "the newest file should be found, got %v", got)
+
+	entries, _, err = objectEntries(dir, SymlinksFollow, Filter{Exclude: []string{"foo"}})
+	require.NoError(t, err)
+	got = entriesModTime(entries)
+	assert.True(t, older.Equal(got), "the excluded files should be skipped, got %v", got)
+}
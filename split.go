@@ -0,0 +1,249 @@
+package s3zip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// listNumbered returns the metadata of the archives in the current format whose keys have a number,
+// the part or pack number returned by number, by object and number.
+func (c *runClient) listNumbered(number func(archiveKey) int) map[string]map[int]*Metadata {
+	res := make(map[string]map[int]*Metadata)
+	for key, m := range c.metadataStore.Metadata {
+		k, ok := parseArchiveKey(c.path, c.outPrefix, key)
+		if !ok || number(k) == 0 {
+			continue
+		}
+		if f, _ := formatOf(key); f != c.format {
+			continue
+		}
+		if res[k.object] == nil {
+			res[k.object] = make(map[int]*Metadata)
+		}
+		res[k.object][number(k)] = m
+	}
+	return res
+}
+
+// planParts splits the object into parts of at most the maximum archive size, and returns the S3 keys of the parts
+// and the parts to upload as they are changed. parts are the uploaded parts of the object by number.
+// It returns no keys if the files of the object do not need to be split, e.g. it is a single file.
+func (c *runClient) planParts(ctx context.Context, object, objectHash string, parts map[int]*Metadata) ([]string, []ObjectToUpload, error) {
+	if c.partsUnchanged(parts, objectHash) {
+		keys := make([]string, 0, len(parts))
+		for number := range parts {
+			keys = append(keys, makeS3PartKey(c.path, c.outPrefix, object, number, c.format))
+		}
+		return keys, nil, nil
+	}
+
+	name := filepath.Join(c.path, object)
+	entries, _, err := objectEntries(name, c.symlinks, c.filter.under(object))
+	if err != nil {
+		return nil, nil, fmt.Errorf("list files %q: %w", object, err)
+	}
+	prev := make([]prevPart, 0, len(parts))
+	for number, m := range parts {
+		if m.Part != nil {
+			prev = append(prev, prevPart{first: m.Part.First, number: number})
+		}
+	}
+	sort.Slice(prev, func(i, j int) bool {
+		return prev[i].first < prev[j].first
+	})
+	groups := splitEntries(entries, c.maxArchiveSize, prev)
+	if len(groups) < 2 {
+		return nil, nil, nil
+	}
+
+	lines, err := hashLines(name, entries, c.hashMode, c.digest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("compute hash %q: %w", object, err)
+	}
+
+	var (
+		keys    []string
+		uploads []ObjectToUpload
+		offset  int
+	)
+	for _, g := range groups {
+		key := makeS3PartKey(c.path, c.outPrefix, object, g.number, c.format)
+		keys = append(keys, key)
+		part := &Part{
+			Index:      int32(g.number),
+			Count:      int32(len(groups)),
+			First:      g.entries[0].rel,
+			ObjectHash: objectHash,
+		}
+		partHash := sumHashLines(lines[offset : offset+len(g.entries)])
+		offset += len(g.entries)
+
+		c.mu.Lock()
+		m, ok := c.metadataStore.Metadata[key]
+		c.mu.Unlock()
+		if ok {
+			unchanged, err := c.unchanged(ctx, key, m, partHash, func(mode HashMode) (string, error) {
+				lines, err := hashLines(name, g.entries, mode, c.digest)
+				if err != nil {
+					return "", err
+				}
+				return sumHashLines(lines), nil
+			})
+			if err != nil {
+				return nil, nil, fmt.Errorf("compare hash %q: %w", key, err)
+			}
+			if unchanged {
+				c.mu.Lock()
+				m.Part = part
+				c.mu.Unlock()
+				continue
+			}
+		}
+
+		uploads = append(uploads, ObjectToUpload{
+			Name:    object,
+			Key:     key,
+			Hash:    partHash,
+			Size:    int(entriesSize(g.entries)),
+			Part:    part,
+			entries: g.entries,
+		})
+	}
+	return keys, uploads, nil
+}
+
+// partsUnchanged reports whether the uploaded parts are complete and were verified against the current hash of the object,
+// so that the object needs no split. The parts are split again if the maximum archive size has been lowered.
+func (c *runClient) partsUnchanged(parts map[int]*Metadata, objectHash string) bool {
+	if len(parts) == 0 {
+		return false
+	}
+	for _, m := range parts {
+		if m.Part == nil || int(m.Part.Count) != len(parts) || m.Part.ObjectHash != objectHash {
+			return false
+		}
+		if m.Dirty || m.SourceSize > c.maxArchiveSize && len(m.Entries) > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// digest returns the SHA-256 of the file, reusing the hash cache if any.
+func (c *runClient) digest(path string, stat os.FileInfo) ([]byte, error) {
+	if c.hashCache != nil {
+		return c.hashCache.fileSHA256(path, stat)
+	}
+	return fileSHA256(path)
+}
+
+type (
+	// prevPart is an uploaded part of an object.
+	prevPart struct {
+		first  string
+		number int
+	}
+
+	// entryGroup is a part of the entries of an object, and its number in the S3 key.
+	entryGroup struct {
+		entries []walkEntry
+		number  int
+	}
+)
+
+// splitEntries splits the sorted entries of an object into consecutive parts whose files are at most maxSize bytes,
+// unless a single file is larger. A part also starts at the first path of each of the uploaded parts prev, sorted by it,
+// and keeps its number, so that a change of a file only changes the part containing it.
+// The parts may be numbered with gaps when files are removed.
+// The parts split off a part which has grown too large are numbered after the numbers in use.
+func splitEntries(entries []walkEntry, maxSize int64, prev []prevPart) []entryGroup {
+	var (
+		groups []entryGroup
+		start  int
+		size   int64
+		next   int
+		number int // the number of the current group, 0 if it is new
+	)
+	used := make(map[int]bool)
+	flush := func(end int) {
+		if number != 0 {
+			used[number] = true
+		}
+		groups = append(groups, entryGroup{entries: entries[start:end], number: number})
+	}
+
+	for i, e := range entries {
+		boundary := 0
+		// The entries before the first part belong to it.
+		for next < len(prev) && (next == 0 || prev[next].first <= e.rel) {
+			boundary = prev[next].number
+			next++
+		}
+		if i > start && (boundary != 0 || size+entrySize(e) > maxSize) {
+			flush(i)
+			start, size, number = i, 0, 0
+		}
+		if boundary != 0 {
+			number = boundary
+		}
+		size += entrySize(e)
+	}
+	if start < len(entries) {
+		flush(len(entries))
+	}
+
+	n := 1
+	for i := range groups {
+		if groups[i].number != 0 {
+			continue
+		}
+		for used[n] {
+			n++
+		}
+		groups[i].number = n
+		used[n] = true
+	}
+	return groups
+}
+
+// statEntries returns the entries with their current info, without the files and links which are removed.
+func statEntries(entries []walkEntry) ([]walkEntry, error) {
+	res := make([]walkEntry, 0, len(entries))
+	for _, e := range entries {
+		stat := os.Stat
+		if e.kind == walkSymlink {
+			stat = os.Lstat
+		}
+		info, err := stat(e.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		e.info = info
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+// entrySize returns the size of the entry, which is 0 but for regular files.
+func entrySize(e walkEntry) int64 {
+	if e.kind != walkFile {
+		return 0
+	}
+	return e.info.Size()
+}
+
+func entriesSize(entries []walkEntry) int64 {
+	var size int64
+	for _, e := range entries {
+		size += entrySize(e)
+	}
+	return size
+}
@@ -0,0 +1,55 @@
+package s3zip
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitEntries(t *testing.T) {
+	dir := setupTestDir(t, "", []testFile{
+		{path: "a", content: strings.Repeat("a", 10)},
+		{path: "b", content: strings.Repeat("b", 10)},
+		{path: "c", content: strings.Repeat("c", 30)},
+		{path: "d/e", content: strings.Repeat("e", 10)},
+		{path: "f", content: strings.Repeat("f", 10)},
+	})
+	entries, _, err := objectEntries(dir, SymlinksFollow, Filter{})
+	require.NoError(t, err)
+
+	split := func(prev []prevPart) map[int][]string {
+		got := make(map[int][]string)
+		for _, g := range splitEntries(entries, 25, prev) {
+			for _, e := range g.entries {
+				got[g.number] = append(got[g.number], e.rel)
+			}
+		}
+		return got
+	}
+
+	t.Run("greedy", func(t *testing.T) {
+		assert.Equal(t, map[int][]string{
+			1: {"a", "b"},
+			2: {"c"},
+			3: {"d/e", "f"},
+		}, split(nil), "a file larger than the maximum size should be a part by itself")
+	})
+
+	t.Run("previous parts", func(t *testing.T) {
+		assert.Equal(t, map[int][]string{
+			1: {"a", "b"},
+			3: {"c"},
+			2: {"d/e", "f"},
+		}, split([]prevPart{{first: "a", number: 1}, {first: "d/e", number: 2}}),
+			"a grown part should be split, keeping the numbers of the other parts")
+
+		assert.Equal(t, map[int][]string{
+			2: {"a", "b"},
+			1: {"c"},
+			3: {"d/e", "f"},
+		}, split([]prevPart{{first: "b", number: 2}, {first: "c", number: 1}}),
+			"the files before the first part should belong to it")
+	})
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package s3zip
+
+import "os"
+
+// oNoFollow is 0 as opening a file without following a link is not available on this platform.
+const oNoFollow = 0
+
+// inode returns 0 as inode numbers are not available on this platform,
+// so HashCache relies on the sizes and modification times only.
+func inode(os.FileInfo) uint64 {
+	return 0
+}
+
+// owner reports that the ownership of files is not available on this platform.
+func owner(os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
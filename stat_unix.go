@@ -0,0 +1,27 @@
+//go:build unix
+
+package s3zip
+
+import (
+	"os"
+	"syscall"
+)
+
+// oNoFollow is the flag to open a file without following a link.
+const oNoFollow = syscall.O_NOFOLLOW
+
+// inode returns the inode number of the file, or 0 if it is not available.
+func inode(stat os.FileInfo) uint64 {
+	if s, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return uint64(s.Ino)
+	}
+	return 0
+}
+
+// owner returns the user and group IDs of the file.
+func owner(stat os.FileInfo) (uid, gid int, ok bool) {
+	if s, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return int(s.Uid), int(s.Gid), true
+	}
+	return 0, 0, false
+}
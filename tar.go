@@ -0,0 +1,159 @@
+package s3zip
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// tarWriter writes a tar stream, compressed as a whole for FormatTarGz and FormatTarZst.
+type tarWriter struct {
+	tw *tar.Writer
+	// compressor is nil for FormatTar.
+	compressor io.WriteCloser
+	strip      bool
+	// reproducible omits the ownership, which depends on the host.
+	reproducible bool
+
+	entries []*Entry
+}
+
+func newTarWriter(w io.Writer, opts PackOptions) (*tarWriter, error) {
+	compression := opts.Compression
+	var compressor io.WriteCloser
+	switch opts.Format {
+	case FormatTar:
+	case FormatTarGz:
+		gw, err := gzip.NewWriterLevel(w, compression.level())
+		if err != nil {
+			return nil, fmt.Errorf("create gzip writer: %w", err)
+		}
+		compressor = gw
+	case FormatTarZst:
+		zopts := []zstd.EOption{}
+		if compression.Level != 0 {
+			zopts = append(zopts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(compression.Level)))
+		}
+		if opts.Reproducible {
+			// The default concurrency depends on the number of CPUs of the host.
+			zopts = append(zopts, zstd.WithEncoderConcurrency(1))
+		}
+		zw, err := zstd.NewWriter(w, zopts...)
+		if err != nil {
+			return nil, fmt.Errorf("create zstd writer: %w", err)
+		}
+		compressor = zw
+	default:
+		return nil, fmt.Errorf("unknown format %q", opts.Format)
+	}
+
+	if compressor != nil {
+		w = compressor
+	}
+	return &tarWriter{
+		tw:           tar.NewWriter(w),
+		compressor:   compressor,
+		strip:        opts.StripAttributes,
+		reproducible: opts.Reproducible,
+	}, nil
+}
+
+func (w *tarWriter) Add(name string, info os.FileInfo, r io.Reader) error {
+	h := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     info.Size(),
+		Mode:     0o644,
+	}
+	if err := w.writeHeader(h, info); err != nil {
+		return err
+	}
+
+	// The size is written in the header first, so the file must not grow or shrink while it is copied.
+	crc := crc32.NewIEEE()
+	if _, err := io.CopyN(io.MultiWriter(w.tw, crc), r, info.Size()); err != nil {
+		return fmt.Errorf("copy file: %w", err)
+	}
+	w.entries = append(w.entries, &Entry{
+		Name:     name,
+		Size:     info.Size(),
+		Modified: timestamppb.New(info.ModTime()),
+		Crc32:    crc.Sum32(),
+	})
+	return nil
+}
+
+func (w *tarWriter) AddDir(name string, info os.FileInfo) error {
+	return w.writeHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0o755,
+	}, info)
+}
+
+func (w *tarWriter) AddSymlink(name string, info os.FileInfo, target string) error {
+	return w.writeHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: target,
+		Mode:     0o777,
+	}, info)
+}
+
+// writeHeader sets the modification time, mode and ownership of the file to the header unless they are stripped, and writes it.
+// The ownership is omitted from reproducible archives.
+func (w *tarWriter) writeHeader(h *tar.Header, info os.FileInfo) error {
+	h.ModTime = time.Unix(0, 0) // restored as unknown
+	if !w.strip {
+		h.Mode = int64(info.Mode().Perm())
+		h.ModTime = info.ModTime()
+		if !w.reproducible {
+			h.Uid, h.Gid, _ = owner(info)
+		}
+	}
+	if err := w.tw.WriteHeader(h); err != nil {
+		return fmt.Errorf("write tar header: %w", err)
+	}
+	return nil
+}
+
+func (w *tarWriter) Close() ([]*Entry, error) {
+	if err := w.tw.Close(); err != nil {
+		return nil, fmt.Errorf("close tar: %w", err)
+	}
+	if w.compressor != nil {
+		if err := w.compressor.Close(); err != nil {
+			return nil, fmt.Errorf("close compressor: %w", err)
+		}
+	}
+	return w.entries, nil
+}
+
+// newTarReader returns a reader of the tar stream of an archive in the format.
+func newTarReader(r io.Reader, format Format) (*tar.Reader, func(), error) {
+	switch format {
+	case FormatTar:
+		return tar.NewReader(r), func() {}, nil
+	case FormatTarGz:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open gzip: %w", err)
+		}
+		return tar.NewReader(gr), func() { gr.Close() }, nil
+	case FormatTarZst:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open zstd: %w", err)
+		}
+		return tar.NewReader(zr), zr.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("%q is not a tar format", format)
+	}
+}
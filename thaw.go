@@ -0,0 +1,358 @@
+package s3zip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	DefaultThawTier = s3.TierBulk
+	DefaultThawDays = 7
+)
+
+// ThawState is the state of the restore request of an archive.
+type ThawState string
+
+const (
+	// ThawStateNotRequested means no restore has been requested for the archive.
+	ThawStateNotRequested ThawState = "not-requested"
+	// ThawStatePending means the restore has been requested and is in progress.
+	ThawStatePending ThawState = "pending"
+	// ThawStateReady means the archive can be downloaded.
+	ThawStateReady ThawState = "ready"
+	// ThawStateExpired means the restore has been requested but the restored copy has expired.
+	ThawStateExpired ThawState = "expired"
+)
+
+type (
+	ThawInput struct {
+		DryRun           bool
+		S3Bucket         string
+		S3Service        s3iface.S3API
+		MetadataStoreKey string
+		Path             string
+		OutPrefix        string
+		Tier             string
+		Days             int
+		Concurrency      int
+	}
+
+	ThawOutput struct {
+		Archives []ThawArchive
+	}
+
+	// ThawArchive is the restore state of an archive.
+	ThawArchive struct {
+		Archive
+		State       ThawState
+		RequestedAt time.Time
+		ExpiresAt   time.Time
+	}
+
+	thawClient struct {
+		dryRun bool
+
+		s3Bucket  string
+		s3Service s3iface.S3API
+
+		metadataStorage *metadataStorage
+		metadataStore   *MetadataStore
+		mu              sync.Mutex
+
+		path      string
+		outPrefix string
+
+		tier string
+		days int
+
+		concurrency int
+	}
+)
+
+func newThawClient(in *ThawInput) *thawClient {
+	c := thawClient{
+		dryRun: in.DryRun,
+
+		s3Bucket:  in.S3Bucket,
+		s3Service: in.S3Service,
+
+		metadataStorage: newMetadataStorage(in.S3Service, in.S3Bucket, in.MetadataStoreKey),
+
+		path:      in.Path,
+		outPrefix: in.OutPrefix,
+
+		tier: in.Tier,
+		days: in.Days,
+
+		concurrency: in.Concurrency,
+	}
+
+	if c.tier == "" {
+		c.tier = DefaultThawTier
+	}
+	if c.days == 0 {
+		c.days = DefaultThawDays
+	}
+	if c.concurrency == 0 {
+		c.concurrency = DefaultConcurrency
+	}
+
+	return &c
+}
+
+// Thaw requests the restore of every archive of a target in a Glacier storage class which is not restored or being restored,
+// and records the pending requests in the metadata store.
+func Thaw(ctx context.Context, in *ThawInput) (*ThawOutput, error) {
+	return newThawClient(in).thaw(ctx)
+}
+
+// ThawStatus reports which archives of a target are ready to be downloaded.
+func ThawStatus(ctx context.Context, in *ThawInput) (*ThawOutput, error) {
+	return newThawClient(in).status(ctx)
+}
+
+func (c *thawClient) thaw(ctx context.Context) (*ThawOutput, error) {
+	if err := validateThawTier(c.tier); err != nil {
+		return nil, err
+	}
+
+	archives, err := c.listFrozenArchives(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.metadataStore, err = c.metadataStorage.load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load metadata store: %w", err)
+	}
+
+	out := &ThawOutput{
+		Archives: make([]ThawArchive, len(archives)),
+	}
+	for i, a := range archives {
+		out.Archives[i] = ThawArchive{
+			Archive:     a,
+			State:       ThawStatePending,
+			RequestedAt: time.Now(),
+		}
+	}
+	if c.dryRun {
+		for _, a := range archives {
+			slog.InfoContext(ctx, "Thawing", "s3-key", a.Key, "tier", c.tier, "days", c.days)
+		}
+		return out, nil
+	}
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(c.concurrency)
+
+	for i, a := range archives {
+		eg.Go(func() error {
+			slog.InfoContext(egCtx, "Thawing", "s3-key", a.Key, "tier", c.tier, "days", c.days)
+			ta, requested, err := c.requestRestore(egCtx, a)
+			if err != nil {
+				return fmt.Errorf("thaw %q: %w", a.Key, err)
+			}
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			out.Archives[i].State, out.Archives[i].ExpiresAt = ta.State, ta.ExpiresAt
+			m, ok := c.metadataStore.Metadata[a.Key]
+			if !ok {
+				// A bare entry would be taken for an uploaded object by run, so the archives unknown to the store are not recorded.
+				slog.WarnContext(egCtx, "Archive is not in the metadata store", "s3-key", a.Key)
+				return nil
+			}
+			if !requested && m.Thaw != nil {
+				out.Archives[i].RequestedAt = m.Thaw.RequestedAt.AsTime()
+				return nil // keep the original request
+			}
+			if ta.State == ThawStateReady {
+				out.Archives[i].RequestedAt = time.Time{} // restored by another request
+				return nil
+			}
+			m.Thaw = &ThawRequest{
+				Tier:        c.tier,
+				Days:        int64(c.days),
+				RequestedAt: timestamppb.New(out.Archives[i].RequestedAt),
+			}
+			return nil
+		})
+	}
+	err = eg.Wait()
+
+	// save the requests which have been made even if some of them failed
+	if serr := c.metadataStorage.save(context.WithoutCancel(ctx), c.metadataStore); serr != nil {
+		err = errors.Join(err, fmt.Errorf("save metadata store: %w", serr))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// requestRestore requests the restore of the archive, unless it is already restored or being restored.
+// It returns the state of the archive, and reports whether the restore has been requested.
+func (c *thawClient) requestRestore(ctx context.Context, a Archive) (ThawArchive, bool, error) {
+	head, err := c.s3Service.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &c.s3Bucket,
+		Key:    aws.String(a.Key),
+	})
+	if err != nil {
+		return ThawArchive{}, false, fmt.Errorf("head: %w", err)
+	}
+	ta, err := parseRestoreHeader(aws.StringValue(head.Restore))
+	if err != nil {
+		return ThawArchive{}, false, fmt.Errorf("parse restore header: %w", err)
+	}
+	switch ta.State {
+	case ThawStateReady:
+		slog.InfoContext(ctx, "Archive is already restored", "s3-key", a.Key, "expires", ta.ExpiresAt)
+		return ta, false, nil
+	case ThawStatePending:
+		slog.InfoContext(ctx, "Restore is already in progress", "s3-key", a.Key)
+		return ta, false, nil
+	}
+
+	_, err = c.s3Service.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+		Bucket: &c.s3Bucket,
+		Key:    aws.String(a.Key),
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(int64(c.days)),
+			GlacierJobParameters: &s3.GlacierJobParameters{
+				Tier: aws.String(c.tier),
+			},
+		},
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == "RestoreAlreadyInProgress" {
+			slog.InfoContext(ctx, "Restore is already in progress", "s3-key", a.Key)
+			return ThawArchive{State: ThawStatePending}, false, nil
+		}
+		return ThawArchive{}, false, fmt.Errorf("restore object: %w", err)
+	}
+	return ThawArchive{State: ThawStatePending}, true, nil
+}
+
+func validateThawTier(tier string) error {
+	switch tier {
+	case s3.TierBulk, s3.TierStandard, s3.TierExpedited:
+		return nil
+	default:
+		return fmt.Errorf("unknown thaw tier %q", tier)
+	}
+}
+
+func (c *thawClient) status(ctx context.Context) (*ThawOutput, error) {
+	archives, err := c.listFrozenArchives(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.metadataStore, err = c.metadataStorage.load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load metadata store: %w", err)
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(c.concurrency)
+
+	out := &ThawOutput{
+		Archives: make([]ThawArchive, len(archives)),
+	}
+	for i, a := range archives {
+		eg.Go(func() error {
+			head, err := c.s3Service.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+				Bucket: &c.s3Bucket,
+				Key:    aws.String(a.Key),
+			})
+			if err != nil {
+				return fmt.Errorf("head %q: %w", a.Key, err)
+			}
+
+			ta, err := parseRestoreHeader(aws.StringValue(head.Restore))
+			if err != nil {
+				return fmt.Errorf("parse restore header of %q: %w", a.Key, err)
+			}
+			ta.Archive = a
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if m, ok := c.metadataStore.Metadata[a.Key]; ok && m.Thaw != nil {
+				ta.RequestedAt = m.Thaw.RequestedAt.AsTime()
+				if ta.State == ThawStateNotRequested {
+					ta.State = ThawStateExpired
+				}
+			}
+
+			slog.InfoContext(ctx, "Thaw status", "s3-key", a.Key, "state", ta.State)
+			out.Archives[i] = ta
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// listFrozenArchives returns the archives which must be restored before being downloaded.
+func (c *thawClient) listFrozenArchives(ctx context.Context) ([]Archive, error) {
+	archives, err := listArchives(ctx, c.s3Service, c.s3Bucket, c.path, c.outPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("list archives: %w", err)
+	}
+
+	res := make([]Archive, 0, len(archives))
+	for _, a := range archives {
+		switch a.StorageClass {
+		case s3.StorageClassGlacier, s3.StorageClassDeepArchive:
+			res = append(res, a)
+		}
+	}
+	slog.InfoContext(ctx, "Listed frozen archives", "len", len(res), "total", len(archives))
+	return res, nil
+}
+
+var restoreHeaderRegexp = regexp.MustCompile(`ongoing-request="(true|false)"(?:,\s*expiry-date="([^"]+)")?`)
+
+// parseRestoreHeader parses the x-amz-restore header of HeadObject,
+// e.g. `ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`.
+func parseRestoreHeader(v string) (ThawArchive, error) {
+	if v == "" {
+		return ThawArchive{State: ThawStateNotRequested}, nil
+	}
+
+	m := restoreHeaderRegexp.FindStringSubmatch(v)
+	if m == nil {
+		return ThawArchive{}, fmt.Errorf("unknown format: %q", v)
+	}
+	if m[1] == "true" {
+		return ThawArchive{State: ThawStatePending}, nil
+	}
+
+	ta := ThawArchive{State: ThawStateReady}
+	if m[2] != "" {
+		t, err := time.Parse(time.RFC1123, m[2])
+		if err != nil {
+			return ThawArchive{}, fmt.Errorf("parse expiry date: %w", err)
+		}
+		ta.ExpiresAt = t
+	}
+	return ta, nil
+}
@@ -0,0 +1,132 @@
+package s3zip
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThaw(t *testing.T) {
+	s3svc := newFakeS3()
+	s3svc.put("pref/target/a.zip", []byte("a"), s3.StorageClassDeepArchive)
+	s3svc.put("pref/target/b.zip", []byte("b"), s3.StorageClassDeepArchive)
+	s3svc.put("pref/target/c.zip", []byte("c"), s3.StorageClassStandard)
+	s3svc.put("pref/other/d.zip", []byte("d"), s3.StorageClassDeepArchive)
+	// b.zip is not in the metadata store, e.g. as it was uploaded by another store.
+	storage := newMetadataStorage(s3svc, "bucket", "metadata.pb")
+	require.NoError(t, storage.save(context.Background(), &MetadataStore{
+		Metadata: map[string]*Metadata{"pref/target/a.zip": {Hash: "a"}},
+	}))
+
+	in := &ThawInput{
+		S3Bucket:         "bucket",
+		S3Service:        s3svc,
+		MetadataStoreKey: "metadata.pb",
+		Path:             "/path/to/target",
+		OutPrefix:        "pref",
+	}
+
+	states := func(t *testing.T) map[string]ThawState {
+		t.Helper()
+
+		out, err := ThawStatus(context.Background(), in)
+		require.NoError(t, err)
+		got := make(map[string]ThawState)
+		for _, a := range out.Archives {
+			got[a.Key] = a.State
+		}
+		return got
+	}
+
+	t.Run("not requested", func(t *testing.T) {
+		assert.Equal(t, map[string]ThawState{
+			"pref/target/a.zip": ThawStateNotRequested,
+			"pref/target/b.zip": ThawStateNotRequested,
+		}, states(t))
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		in := *in
+		in.DryRun = true
+		out, err := Thaw(context.Background(), &in)
+		require.NoError(t, err)
+		assert.Len(t, out.Archives, 2)
+		assert.Equal(t, map[string]ThawState{
+			"pref/target/a.zip": ThawStateNotRequested,
+			"pref/target/b.zip": ThawStateNotRequested,
+		}, states(t))
+	})
+
+	t.Run("request", func(t *testing.T) {
+		out, err := Thaw(context.Background(), in)
+		require.NoError(t, err)
+		assert.Len(t, out.Archives, 2)
+
+		store, err := storage.load(context.Background())
+		require.NoError(t, err)
+		require.Contains(t, store.Metadata, "pref/target/a.zip")
+		assert.Equal(t, "a", store.Metadata["pref/target/a.zip"].Hash)
+		assert.Equal(t, DefaultThawTier, store.Metadata["pref/target/a.zip"].Thaw.Tier)
+		assert.EqualValues(t, DefaultThawDays, store.Metadata["pref/target/a.zip"].Thaw.Days)
+		assert.NotContains(t, store.Metadata, "pref/target/b.zip", "unknown archives should not be added to the store")
+
+		assert.Equal(t, map[string]ThawState{
+			"pref/target/a.zip": ThawStatePending,
+			"pref/target/b.zip": ThawStatePending,
+		}, states(t))
+	})
+
+	t.Run("request again while pending", func(t *testing.T) {
+		_, err := Thaw(context.Background(), in)
+		require.NoError(t, err)
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		expiry := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+		s3svc.completeRestore("pref/target/a.zip", expiry)
+
+		out, err := ThawStatus(context.Background(), in)
+		require.NoError(t, err)
+		require.Len(t, out.Archives, 2)
+		assert.Equal(t, ThawStateReady, out.Archives[0].State)
+		assert.True(t, expiry.Equal(out.Archives[0].ExpiresAt))
+		assert.False(t, out.Archives[0].RequestedAt.IsZero())
+		assert.Equal(t, ThawStatePending, out.Archives[1].State)
+
+		out, err = Thaw(context.Background(), in)
+		require.NoError(t, err)
+		require.Len(t, out.Archives, 2)
+		assert.Equal(t, ThawStateReady, out.Archives[0].State, "a restored archive should not be restored again")
+		assert.True(t, expiry.Equal(out.Archives[0].ExpiresAt))
+		assert.Equal(t, ThawStateReady, states(t)["pref/target/a.zip"])
+	})
+
+	t.Run("invalid tier", func(t *testing.T) {
+		in := *in
+		in.Tier = "Fast"
+		_, err := Thaw(context.Background(), &in)
+		assert.Error(t, err)
+	})
+}
+
+func TestParseRestoreHeader(t *testing.T) {
+	got, err := parseRestoreHeader(`ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`)
+	require.NoError(t, err)
+	assert.Equal(t, ThawStateReady, got.State)
+	assert.Equal(t, time.Date(2012, 12, 21, 0, 0, 0, 0, time.UTC), got.ExpiresAt.UTC())
+
+	got, err = parseRestoreHeader(`ongoing-request="true"`)
+	require.NoError(t, err)
+	assert.Equal(t, ThawStatePending, got.State)
+
+	got, err = parseRestoreHeader("")
+	require.NoError(t, err)
+	assert.Equal(t, ThawStateNotRequested, got.State)
+
+	_, err = parseRestoreHeader("unknown")
+	require.Error(t, err)
+}
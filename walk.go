@@ -0,0 +1,243 @@
+package s3zip
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"log/slog"
+)
+
+// SymlinkPolicy selects how the symbolic links in the objects are archived.
+type SymlinkPolicy string
+
+const (
+	// SymlinksFollow archives the files and directories which the links point to. It is the default policy.
+	// Dangling links and links to their own ancestors are skipped.
+	SymlinksFollow SymlinkPolicy = "follow"
+	// SymlinksPreserve archives the links themselves.
+	SymlinksPreserve SymlinkPolicy = "preserve"
+	// SymlinksSkip ignores the links.
+	SymlinksSkip SymlinkPolicy = "skip"
+)
+
+func (p SymlinkPolicy) orDefault() SymlinkPolicy {
+	if p == "" {
+		return SymlinksFollow
+	}
+	return p
+}
+
+func (p SymlinkPolicy) validate() error {
+	switch p.orDefault() {
+	case SymlinksFollow, SymlinksPreserve, SymlinksSkip:
+		return nil
+	default:
+		return fmt.Errorf("unknown symlink policy %q", p)
+	}
+}
+
+type walkKind int
+
+const (
+	walkFile walkKind = iota
+	walkDir
+	walkSymlink
+)
+
+// walkEntry is a regular file, a directory or a preserved symbolic link of an object.
+type walkEntry struct {
+	kind walkKind
+	// rel is the slash-separated path relative to the object, "." for the object itself.
+	rel string
+	// path is the local path.
+	path string
+	// info describes the file or directory, which is the target of a followed link, or the link itself if preserved.
+	// It is nil for regular files unless they are stat'ed.
+	info os.FileInfo
+	// target is the destination of a preserved link.
+	target string
+	// empty reports whether a directory has no entries.
+	empty bool
+}
+
+// walkObject calls fn for the entries of the object at name selected by the filter and the ignore files, by the symlink policy,
+// and returns the ignore files which have been applied, including those of the ancestors of the object in the target of the filter.
+// Files and links are visited in lexical order, and each directory is visited after its entries.
+// A directory whose entries are all filtered out is skipped, as is an empty one which is not included by the filter.
+// Other files such as devices and sockets are ignored. Hash, Size and Pack use it to agree on the contents of an object.
+// If statFiles is false, the info of regular files is nil, which saves a stat call per file.
+func walkObject(name string, symlinks SymlinkPolicy, filter Filter, statFiles bool, fn func(walkEntry) error) ([]*ignoreFile, error) {
+	root := name
+	if prefix := filter.path("."); prefix != "" {
+		for range strings.Split(prefix, "/") {
+			root = filepath.Dir(root)
+		}
+	}
+	w := &walker{
+		symlinks:  symlinks.orDefault(),
+		filter:    filter,
+		ignores:   newIgnoreMatcher(root),
+		statFiles: statFiles,
+		fn:        fn,
+		ancestors: make(map[string]bool),
+	}
+	info, err := os.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.walk(name, ".", info.Mode().Type(), func() (os.FileInfo, error) { return info, nil })
+	return w.ignores.files, err
+}
+
+type walker struct {
+	symlinks  SymlinkPolicy
+	filter    Filter
+	ignores   *ignoreMatcher
+	statFiles bool
+	fn        func(walkEntry) error
+	// filtered is the number of entries skipped by the filter and the ignore files.
+	filtered int
+	// ancestors are the real paths of the directories being walked, to detect link loops.
+	ancestors map[string]bool
+}
+
+// walk visits the file at p of the type typ, and reports whether it has been visited.
+// stat returns the info of the file without following links.
+func (w *walker) walk(p, rel string, typ os.FileMode, stat func() (os.FileInfo, error)) (bool, error) {
+	if w.filter.excluded(rel) {
+		w.filtered++
+		return false, nil
+	}
+	if typ&os.ModeSymlink != 0 {
+		switch w.symlinks {
+		case SymlinksSkip:
+			return false, nil
+		case SymlinksPreserve:
+			if skip, err := w.skip(rel, false); err != nil || skip {
+				return false, err
+			}
+			info, err := stat()
+			if err != nil {
+				return false, err
+			}
+			target, err := os.Readlink(p)
+			if err != nil {
+				return false, fmt.Errorf("read link: %w", err)
+			}
+			return true, w.fn(walkEntry{kind: walkSymlink, rel: rel, path: p, info: info, target: target})
+		}
+
+		info, err := os.Stat(p)
+		if err != nil {
+			slog.Warn("Skipping dangling symlink", "path", p, "error", err)
+			return false, nil
+		}
+		typ, stat = info.Mode().Type(), func() (os.FileInfo, error) { return info, nil }
+	}
+	if skip, err := w.skip(rel, typ.IsDir()); err != nil || skip {
+		return false, err
+	}
+
+	switch {
+	case typ.IsDir():
+		info, err := stat()
+		if err != nil {
+			return false, err
+		}
+		return w.walkDir(p, rel, info)
+	case typ.IsRegular():
+		var info os.FileInfo
+		if w.statFiles {
+			var err error
+			if info, err = stat(); err != nil {
+				return false, err
+			}
+		}
+		return true, w.fn(walkEntry{kind: walkFile, rel: rel, path: p, info: info})
+	default:
+		slog.Debug("Skipping irregular file", "path", p, "type", typ)
+		return false, nil
+	}
+}
+
+// skip reports whether the entry at rel is skipped by the ignore files, or by the includes of the filter unless it is a directory.
+// The excludes of the filter are matched before the links are followed.
+func (w *walker) skip(rel string, dir bool) (bool, error) {
+	if !dir && !w.filter.included(rel) {
+		w.filtered++
+		return true, nil
+	}
+	p := w.filter.path(rel)
+	if p == "" {
+		return false, nil
+	}
+	ignored, err := w.ignores.ignored(p, dir)
+	if err != nil {
+		return false, err
+	}
+	if ignored {
+		w.filtered++
+	}
+	return ignored, nil
+}
+
+func (w *walker) walkDir(p, rel string, info os.FileInfo) (bool, error) {
+	// Only followed links can lead to an ancestor.
+	if w.symlinks == SymlinksFollow {
+		real, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return false, err
+		}
+		if w.ancestors[real] {
+			slog.Warn("Skipping symlink loop", "path", p)
+			return false, nil
+		}
+		w.ancestors[real] = true
+		defer delete(w.ancestors, real)
+	}
+
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return false, err
+	}
+
+	empty, filtered := true, w.filtered
+	for _, e := range entries {
+		visited, err := w.walk(filepath.Join(p, e.Name()), path.Join(rel, e.Name()), e.Type(), e.Info)
+		if err != nil {
+			return false, err
+		}
+		if visited {
+			empty = false
+		}
+	}
+	if empty && (w.filtered != filtered || !w.filter.included(rel)) {
+		w.filtered++
+		return false, nil
+	}
+	return true, w.fn(walkEntry{kind: walkDir, rel: rel, path: p, info: info, empty: empty})
+}
+
+// The kinds of the objects, see Metadata.ObjectKind.
+const (
+	objectKindFile = "file"
+	objectKindDir  = "dir"
+)
+
+// objectKind returns the kind of the object at name, which is a directory if it is one or a link followed to one.
+func objectKind(name string, symlinks SymlinkPolicy) (string, error) {
+	info, err := os.Lstat(name)
+	if err == nil && info.Mode()&os.ModeSymlink != 0 && symlinks.orDefault() == SymlinksFollow {
+		info, err = os.Stat(name)
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return objectKindDir, nil
+	}
+	return objectKindFile, nil
+}
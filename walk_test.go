@@ -0,0 +1,117 @@
+package s3zip
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSymlinkPolicy(t *testing.T) {
+	dir := setupTestDir(t, "target", []testFile{
+		{path: "a.txt", content: "a"},
+		{path: "foo/b.txt", content: "bb"},
+	})
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "empty"), 0o755))
+	require.NoError(t, os.Symlink("a.txt", filepath.Join(dir, "link.txt")))
+	require.NoError(t, os.Symlink("foo", filepath.Join(dir, "linkdir")))
+	require.NoError(t, os.Symlink("none", filepath.Join(dir, "dangling")))
+	require.NoError(t, os.Symlink("..", filepath.Join(dir, "foo", "loop")))
+
+	tests := []struct {
+		symlinks SymlinkPolicy
+		entries  []string
+		size     int
+	}{
+		{
+			symlinks: SymlinksFollow,
+			entries:  []string{"a.txt", "empty/", "foo/b.txt", "link.txt", "linkdir/b.txt"},
+			size:     6,
+		},
+		{
+			symlinks: SymlinksPreserve,
+			entries:  []string{"a.txt", "dangling", "empty/", "foo/b.txt", "foo/loop", "link.txt", "linkdir"},
+			size:     3,
+		},
+		{
+			symlinks: SymlinksSkip,
+			entries:  []string{"a.txt", "empty/", "foo/b.txt"},
+			size:     3,
+		},
+	}
+	hashes := make(map[string]bool)
+	for _, tt := range tests {
+		t.Run(string(tt.symlinks), func(t *testing.T) {
+			for _, format := range []Format{FormatZip, FormatTar} {
+				r := Pack(dir, PackOptions{Format: format, Symlinks: tt.symlinks})
+				b, err := io.ReadAll(r)
+				require.NoError(t, err)
+				assert.Equal(t, tt.entries, archiveNames(t, b, format), format)
+			}
+
+			size, err := Size(dir, tt.symlinks, Filter{})
+			require.NoError(t, err)
+			assert.Equal(t, tt.size, size)
+
+			h, err := Hash(dir, HashModeSize, tt.symlinks, Filter{})
+			require.NoError(t, err)
+			assert.False(t, hashes[h], "the hash should depend on the policy")
+			hashes[h] = true
+		})
+	}
+
+	t.Run("objects", func(t *testing.T) {
+		for symlinks, want := range map[SymlinkPolicy][]string{
+			SymlinksFollow:   {"a.txt", "empty", "foo", "link.txt", "linkdir"},
+			SymlinksPreserve: {"a.txt", "dangling", "empty", "foo", "link.txt", "linkdir"},
+			SymlinksSkip:     {"a.txt", "empty", "foo"},
+		} {
+			got, err := LocalObjects(dir, 1, nil, symlinks, Filter{})
+			require.NoError(t, err)
+			assert.Equal(t, want, got, symlinks)
+		}
+	})
+
+	t.Run("empty directory changes hash", func(t *testing.T) {
+		before, err := Hash(dir, HashModeSize, SymlinksSkip, Filter{})
+		require.NoError(t, err)
+		require.NoError(t, os.Mkdir(filepath.Join(dir, "empty", "sub"), 0o755))
+		after, err := Hash(dir, HashModeSize, SymlinksSkip, Filter{})
+		require.NoError(t, err)
+		assert.NotEqual(t, before, after)
+	})
+}
+
+// archiveNames returns the sorted entry names of the archive.
+func archiveNames(t *testing.T, b []byte, format Format) []string {
+	t.Helper()
+
+	var names []string
+	if format == FormatZip {
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		require.NoError(t, err)
+		for _, zf := range zr.File {
+			names = append(names, zf.Name)
+		}
+	} else {
+		tr, closeTar, err := newTarReader(bytes.NewReader(b), format)
+		require.NoError(t, err)
+		defer closeTar()
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, h.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -2,62 +2,195 @@ package s3zip
 
 import (
 	"archive/zip"
+	"compress/flate"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-// Zip creates a zip file from the given directory.
-func Zip(name string) io.ReadCloser {
-	pr, pw := io.Pipe()
-	go func() {
-		zw := zip.NewWriter(pw)
-		defer zw.Close()
-
-		err := filepath.Walk(name, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return nil
-			}
-
-			rel, err := filepath.Rel(name, path)
-			if err != nil {
-				return fmt.Errorf("get relative path: %w", err)
-			}
-			if rel == "." {
-				rel = filepath.Base(name)
-			}
-
-			zw2, err := zw.CreateHeader(&zip.FileHeader{
-				Name:   filepath.ToSlash(rel),
-				Method: zip.Deflate,
-			})
-			if err != nil {
-				return fmt.Errorf("create zip file: %w", err)
-			}
-			f, err := os.Open(path)
-			if err != nil {
-				return fmt.Errorf("open file: %w", err)
-			}
-			defer f.Close()
-			if _, err := io.Copy(zw2, f); err != nil {
-				return fmt.Errorf("copy file: %w", err)
-			}
-			return nil
-		})
-		if err != nil {
-			pw.CloseWithError(fmt.Errorf("walk: %w", err))
-			return
+// zipExtraUnixOwner is the ID of the Info-ZIP Unix extra field, which holds the user and group IDs of a file.
+const zipExtraUnixOwner = 0x7875
+
+// zipWriter writes a zip archive, compressing each file by the compression policy.
+type zipWriter struct {
+	zw          *zip.Writer
+	compression Compression
+	strip       bool
+	// reproducible omits the ownership and writes the timestamps in UTC, independent of the host.
+	reproducible bool
+
+	headers  []*zip.FileHeader
+	modTimes []time.Time
+}
+
+func newZipWriter(w io.Writer, opts PackOptions) *zipWriter {
+	compression := opts.Compression
+	zw := zip.NewWriter(w)
+	zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, compression.level())
+	})
+	return &zipWriter{
+		zw:           zw,
+		compression:  compression,
+		strip:        opts.StripAttributes,
+		reproducible: opts.Reproducible,
+	}
+}
+
+func (w *zipWriter) Add(name string, info os.FileInfo, r io.Reader) error {
+	var sample []byte
+	if w.compression.Auto {
+		sample = make([]byte, autoCompressionSampleSize)
+		n, err := io.ReadFull(r, sample)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("read file: %w", err)
+		}
+		sample = sample[:n]
+	}
+
+	fh := &zip.FileHeader{
+		Name:   name,
+		Method: w.compression.method(name, sample),
+	}
+	w.setAttributes(fh, info)
+	fw, err := w.zw.CreateHeader(fh)
+	if err != nil {
+		return fmt.Errorf("create zip file: %w", err)
+	}
+	w.headers = append(w.headers, fh)
+	w.modTimes = append(w.modTimes, info.ModTime())
+
+	if _, err := fw.Write(sample); err != nil {
+		return fmt.Errorf("copy file: %w", err)
+	}
+	if _, err := io.Copy(fw, r); err != nil {
+		return fmt.Errorf("copy file: %w", err)
+	}
+	return nil
+}
+
+func (w *zipWriter) AddDir(name string, info os.FileInfo) error {
+	fh := &zip.FileHeader{
+		Name:   name + "/",
+		Method: zip.Store,
+	}
+	w.setAttributes(fh, info)
+	if _, err := w.zw.CreateHeader(fh); err != nil {
+		return fmt.Errorf("create zip directory: %w", err)
+	}
+	return nil
+}
+
+// AddSymlink writes the link as an entry whose content is the target, marked by the Unix mode bits as Info-ZIP does.
+func (w *zipWriter) AddSymlink(name string, info os.FileInfo, target string) error {
+	fh := &zip.FileHeader{
+		Name:   name,
+		Method: zip.Store,
+	}
+	fh.SetMode(os.ModeSymlink | 0o777)
+	w.setAttributes(fh, info)
+	fw, err := w.zw.CreateHeader(fh)
+	if err != nil {
+		return fmt.Errorf("create zip symlink: %w", err)
+	}
+	if _, err := io.WriteString(fw, target); err != nil {
+		return fmt.Errorf("write zip symlink: %w", err)
+	}
+	return nil
+}
+
+// setAttributes sets the modification time, mode and ownership of the file to the header unless they are stripped.
+// The ownership is omitted from reproducible archives.
+func (w *zipWriter) setAttributes(fh *zip.FileHeader, info os.FileInfo) {
+	if w.strip {
+		return
+	}
+	fh.Modified = info.ModTime()
+	fh.SetMode(info.Mode())
+	if w.reproducible {
+		// The MS-DOS time is written in the location of Modified.
+		fh.Modified = fh.Modified.UTC()
+		return
+	}
+	if uid, gid, ok := owner(info); ok {
+		fh.Extra = zipUnixOwnerExtra(uid, gid)
+	}
+}
+
+func (w *zipWriter) Close() ([]*Entry, error) {
+	if err := w.zw.Close(); err != nil {
+		return nil, fmt.Errorf("close zip: %w", err)
+	}
+
+	// The sizes and checksums are set to the headers when the files are closed.
+	entries := make([]*Entry, len(w.headers))
+	for i, fh := range w.headers {
+		entries[i] = &Entry{
+			Name:     fh.Name,
+			Size:     int64(fh.UncompressedSize64),
+			Modified: timestamppb.New(w.modTimes[i]),
+			Crc32:    fh.CRC32,
+			Method:   uint32(fh.Method),
+		}
+	}
+	return entries, nil
+}
+
+// zipUnixOwnerExtra returns the Info-ZIP Unix extra field of the user and group IDs.
+func zipUnixOwnerExtra(uid, gid int) []byte {
+	b := make([]byte, 0, 15)
+	b = binary.LittleEndian.AppendUint16(b, zipExtraUnixOwner)
+	b = binary.LittleEndian.AppendUint16(b, 11)
+	b = append(b, 1, 4) // version, size of uid
+	b = binary.LittleEndian.AppendUint32(b, uint32(uid))
+	b = append(b, 4) // size of gid
+	b = binary.LittleEndian.AppendUint32(b, uint32(gid))
+	return b
+}
+
+// parseZipUnixOwnerExtra returns the user and group IDs in the Info-ZIP Unix extra field of the extra fields.
+func parseZipUnixOwnerExtra(extra []byte) (uid, gid int, ok bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return 0, 0, false
 		}
-		if err := zw.Close(); err != nil {
-			pw.CloseWithError(fmt.Errorf("close zip: %w", err))
-			return
+		data := extra[4 : 4+size]
+		extra = extra[4+size:]
+		if id != zipExtraUnixOwner || len(data) < 2 || data[0] != 1 {
+			continue
 		}
-		pw.Close()
-	}()
 
-	return pr
+		uid, data, ok := readZipUnixID(data[1:])
+		if !ok {
+			return 0, 0, false
+		}
+		gid, _, ok := readZipUnixID(data)
+		if !ok {
+			return 0, 0, false
+		}
+		return uid, gid, true
+	}
+	return 0, 0, false
+}
+
+// readZipUnixID reads a size-prefixed little-endian ID of the Info-ZIP Unix extra field.
+func readZipUnixID(data []byte) (int, []byte, bool) {
+	if len(data) < 1 {
+		return 0, nil, false
+	}
+	size := int(data[0])
+	if size == 0 || size > 8 || len(data) < 1+size {
+		return 0, nil, false
+	}
+	var id uint64
+	for i := size; i >= 1; i-- {
+		id = id<<8 | uint64(data[i])
+	}
+	return int(id), data[1+size:], true
 }
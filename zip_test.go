@@ -1,6 +1,9 @@
 package s3zip
 
 import (
+	"archive/zip"
+	"bytes"
+	"hash/crc32"
 	"io"
 	"path/filepath"
 	"testing"
@@ -30,4 +33,52 @@ func TestZip(t *testing.T) {
 		require.NoError(t, err)
 		assert.Greater(t, written, int64(0))
 	})
+
+	t.Run("entries", func(t *testing.T) {
+		r := Zip(dir)
+		defer r.Close()
+		_, err := io.Copy(io.Discard, r)
+		require.NoError(t, err)
+
+		entries := r.Entries()
+		require.Len(t, entries, 2)
+		assert.Equal(t, "a.txt", entries[0].Name)
+		assert.EqualValues(t, 1, entries[0].Size)
+		assert.Equal(t, crc32.ChecksumIEEE([]byte("a")), entries[0].Crc32)
+		assert.False(t, entries[0].Modified.AsTime().IsZero())
+		assert.Equal(t, "b.txt", entries[1].Name)
+	})
+
+	t.Run("compression", func(t *testing.T) {
+		r := ZipCompressed(dir, Compression{Store: []string{".txt"}})
+		defer r.Close()
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+
+		for _, e := range r.Entries() {
+			assert.EqualValues(t, zip.Store, e.Method, e.Name)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		require.NoError(t, err)
+		for _, f := range zr.File {
+			assert.Equal(t, zip.Store, f.Method, f.Name)
+		}
+	})
+}
+
+func TestZipUnixOwnerExtra(t *testing.T) {
+	extra := append([]byte{0x55, 0x54, 1, 0, 0}, zipUnixOwnerExtra(1000, 100)...) // after an extended timestamp field
+	uid, gid, ok := parseZipUnixOwnerExtra(extra)
+	require.True(t, ok)
+	assert.Equal(t, 1000, uid)
+	assert.Equal(t, 100, gid)
+
+	// uid and gid of other sizes
+	uid, gid, ok = parseZipUnixOwnerExtra([]byte{0x75, 0x78, 6, 0, 1, 2, 0xe8, 0x03, 1, 0x64})
+	require.True(t, ok)
+	assert.Equal(t, 1000, uid)
+	assert.Equal(t, 100, gid)
+
+	_, _, ok = parseZipUnixOwnerExtra([]byte{0x75, 0x78, 3, 0, 1, 4, 0})
+	assert.False(t, ok)
 }